@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// The access log has a line per proxied request in the Combined Log Format,
+// followed by the cache status (HIT, MISS or - for the requests which are not
+// cached). The line is written once the body is sent, with its size.
+
+// An access log file reopened by Reopen, for logrotate
+type AccessLog struct {
+	mu    sync.Mutex
+	fname string
+	f     *os.File
+}
+
+// Opens fname in append mode, - is stdout
+func OpenAccessLog(fname string) (*AccessLog, error) {
+	l := &AccessLog{fname: fname}
+	if fname == "-" {
+		l.f = os.Stdout
+		return l, nil
+	}
+	return l, l.Reopen()
+}
+
+func (l *AccessLog) Reopen() error {
+	if l.fname == "-" {
+		return nil
+	}
+	f, err := os.OpenFile(l.fname, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	old := l.f
+	l.f = f
+	l.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (l *AccessLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Write(p)
+}
+
+// HIT, MISS or - for the requests which are not cached
+func (st *reqState) cacheStatus() string {
+	if st.hit {
+		return "HIT"
+	} else if st.miss {
+		return "MISS"
+	}
+	return "-"
+}
+
+// Writes the line of resp when its body is closed
+func (c *Cache) logAccess(resp *http.Response, ctx *goproxy.ProxyCtx) {
+	req, status := ctx.Req, stateOf(ctx).cacheStatus()
+	onBodyClose(resp, req, func(bytes int64) {
+		fmt.Fprintln(c.cfg.AccessLog, combinedLogLine(req, resp.StatusCode, bytes, time.Now())+" "+status)
+	})
+}
+
+// Calls done with the number of bytes read from the body of resp once it is
+// closed, at once with 0 if there is no body to wrap
+func onBodyClose(resp *http.Response, req *http.Request, done func(bytes int64)) {
+	// A new body would make goproxy drop the Content-Length of a HEAD
+	if resp.Body == nil || resp.Body == http.NoBody || req.Method == "HEAD" {
+		done(0)
+		return
+	}
+	resp.Body = &countingBody{ReadCloser: resp.Body, done: done}
+}
+
+// Counts the bytes read from a body, calls done once when it is closed
+type countingBody struct {
+	io.ReadCloser
+	done  func(bytes int64)
+	bytes int64
+	once  sync.Once
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	return n, err
+}
+
+// Keeps the chunked copy of a hitBody
+func (b *countingBody) WriteTo(w io.Writer) (int64, error) {
+	if wt, ok := b.ReadCloser.(io.WriterTo); ok {
+		n, err := wt.WriteTo(w)
+		b.bytes += n
+		return n, err
+	}
+	return io.Copy(w, struct{ io.Reader }{b})
+}
+
+func (b *countingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.done(b.bytes) })
+	return err
+}
+
+func combinedLogLine(req *http.Request, status int, bytes int64, t time.Time) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	size := "-"
+	if bytes > 0 {
+		size = fmt.Sprint(bytes)
+	}
+	return fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s %q %q",
+		orDash(host), t.Format("02/Jan/2006:15:04:05 -0700"), req.Method, req.URL, req.Proto,
+		status, size, orDash(req.Referer()), orDash(req.UserAgent()))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
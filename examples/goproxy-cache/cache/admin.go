@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The admin routes are never proxied. The read-only ones are also served on the
+// proxy port (as the NonproxyHandler), the others only on the management listener.
+func (c *Cache) AdminHandler(management bool) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_cache/stats", c.statsHandler)
+	mux.HandleFunc("/_cache/healthz", c.healthzHandler)
+	mux.HandleFunc("/_cache/readyz", c.readyzHandler)
+	mux.HandleFunc("/_cache/peer/blobs/", c.peerBlobHandler)
+	if management {
+		mux.HandleFunc("/_cache/blobs", c.blobsHandler)
+		mux.HandleFunc("/_cache/blobs/", c.blobsHandler)
+		mux.HandleFunc("/_cache/pin/", c.pinHandler)
+	}
+	return mux
+}
+
+type removedBlob struct {
+	Host   string `json:"host,omitempty"`
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+func newRemovedBlob(key string, size int64) removedBlob {
+	host, shaname := splitKey(key)
+	return removedBlob{Host: host, Digest: "sha256:" + shaname, Size: size}
+}
+
+type listedBlob struct {
+	Host       string    `json:"host,omitempty"`
+	Digest     string    `json:"digest"`
+	Size       int64     `json:"size"`
+	DiskSize   int64     `json:"disk_size"`
+	LastAccess time.Time `json:"last_access"`
+	Hits       int64     `json:"hits"`
+	Status     string    `json:"status"`
+	Pinned     bool      `json:"pinned"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// GET /_cache/blobs lists the blobs, DELETE /_cache/blobs flushes the cache,
+// DELETE /_cache/blobs/[<host>/]<digest> removes one blob, the host is needed
+// with Config.NamespaceByHost
+func (c *Cache) blobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" && strings.TrimSuffix(r.URL.Path, "/") == "/_cache/blobs" {
+		c.blobListHandler(w, r)
+		return
+	}
+	if r.Method != "DELETE" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	digest := strings.TrimPrefix(r.URL.Path, "/_cache/blobs")
+	digest = strings.TrimPrefix(digest, "/")
+	if digest == "" {
+		writeJSON(w, http.StatusOK, map[string][]removedBlob{"removed": c.purgeAll()})
+		return
+	}
+
+	shaname, ok := c.parseKey(digest)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "invalid digest "+digest)
+		return
+	}
+
+	c.mu.Lock()
+	entry := c.entries[shaname]
+	switch {
+	case entry == nil || entry.status == EMPTY || entry.status == FAILED:
+		c.mu.Unlock()
+		writeJSONError(w, http.StatusNotFound, "blob not in cache")
+	case entry.status == IN_PROGRESS:
+		c.mu.Unlock()
+		writeJSONError(w, http.StatusConflict, "blob download in progress")
+	default:
+		removed := newRemovedBlob(shaname, entry.size)
+		c.removeEntry(shaname)
+		c.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string][]removedBlob{"removed": {removed}})
+	}
+}
+
+// Returns the cache key of a [host/]sha256:<hex> digest
+func (c *Cache) parseKey(digest string) (string, bool) {
+	host := ""
+	if i := strings.LastIndex(digest, "/"); i >= 0 {
+		host, digest = digest[:i], digest[i+1:]
+	}
+	shaname := strings.TrimPrefix(digest, "sha256:")
+	if !blobNameRe.MatchString(shaname) {
+		return "", false
+	}
+	return c.blobKey(host, shaname), true
+}
+
+// Removes every AVAILABLE entry, the downloads in progress are kept
+func (c *Cache) purgeAll() []removedBlob {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := []removedBlob{}
+	for shaname, entry := range c.entries {
+		if entry.status == AVAILABLE {
+			removed = append(removed, newRemovedBlob(shaname, entry.size))
+			c.removeEntry(shaname)
+		}
+	}
+	return removed
+}
+
+// Lists the blobs sorted by digest, or with ?sort=size the biggest first, with
+// ?sort=atime the least recently used first and with ?sort=hits the most hit
+// first. ?limit=N keeps the first N.
+func (c *Cache) blobListHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 0
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid limit "+s)
+			return
+		}
+		limit = n
+	}
+
+	blobs := c.blobList()
+	var less func(a, b listedBlob) bool
+	switch q.Get("sort") {
+	case "":
+		less = func(a, b listedBlob) bool { return a.Host+a.Digest < b.Host+b.Digest }
+	case "size":
+		less = func(a, b listedBlob) bool { return a.DiskSize > b.DiskSize }
+	case "atime":
+		less = func(a, b listedBlob) bool { return a.LastAccess.Before(b.LastAccess) }
+	case "hits":
+		less = func(a, b listedBlob) bool { return a.Hits > b.Hits }
+	default:
+		writeJSONError(w, http.StatusBadRequest, "invalid sort "+q.Get("sort")+", expected size, atime or hits")
+		return
+	}
+	sort.SliceStable(blobs, func(i, j int) bool { return less(blobs[i], blobs[j]) })
+	if limit > 0 && len(blobs) > limit {
+		blobs = blobs[:limit]
+	}
+	writeJSON(w, http.StatusOK, blobs)
+}
+
+// The AVAILABLE and IN_PROGRESS entries
+func (c *Cache) blobList() []listedBlob {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	blobs := []listedBlob{}
+	for shaname, entry := range c.entries {
+		status := "available"
+		switch entry.status {
+		case EMPTY, FAILED:
+			continue
+		case IN_PROGRESS:
+			status = "in_progress"
+		}
+		host, digest := splitKey(shaname)
+		blobs = append(blobs, listedBlob{
+			Host:       host,
+			Digest:     "sha256:" + digest,
+			Size:       entry.size,
+			DiskSize:   entry.diskSize,
+			LastAccess: entry.atime,
+			Hits:       atomic.LoadInt64(&entry.hits),
+			Status:     status,
+			Pinned:     c.isPinned(shaname),
+		})
+	}
+	return blobs
+}
@@ -0,0 +1,28 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// The proxy never touches the authentication: the Authorization and
+// WWW-Authenticate headers, the 401 challenges and the token service requests
+// go through untouched, so the clients get their own tokens.
+//
+// Blobs are cached by digest only, which does not depend on who pulled them.
+// A blob fetched with credentials is only served from the cache to the
+// requests which carry some too; the others are forwarded and get the
+// challenge of the upstream. A manifest fetched with credentials is only
+// served to the requests with the same Authorization header. Note that Docker Hub sends the blobs from its CDN
+// without credentials, those are seen as public.
+
+func hasCredentials(req *http.Request) bool {
+	return req.Header.Get("Authorization") != ""
+}
+
+// Identifies the Authorization header of req in a cache key
+func authHash(req *http.Request) string {
+	sum := sha256.Sum256([]byte(req.Header.Get("Authorization")))
+	return hex.EncodeToString(sum[:8])
+}
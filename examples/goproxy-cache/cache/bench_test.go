@@ -0,0 +1,167 @@
+//go:build !windows
+
+package cache
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Process CPU time, user and system, so that the kernel copy of sendfile
+// is compared with the copy through user space
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// Serves a 32MB hit to a local client, as a plain file which can be sent with
+// sendfile(2) and hidden behind a reader which cannot
+func BenchmarkServeHit(b *testing.B) {
+	const size = 32 << 20
+	fname := filepath.Join(b.TempDir(), "blob")
+	if err := ioutil.WriteFile(fname, make([]byte, size), 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bench := range []struct {
+		name string
+		wrap func(f *os.File) io.ReadCloser
+	}{
+		{"sendfile", func(f *os.File) io.ReadCloser { return f }},
+		{"copy", func(f *os.File) io.ReadCloser { return ioutil.NopCloser(f) }},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			var served int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				f, err := os.Open(fname)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(size))
+				io.Copy(w, &hitBody{bench.wrap(f), nil, &served, nil})
+				f.Close()
+			}))
+			defer srv.Close()
+
+			b.SetBytes(size)
+			b.ResetTimer()
+			start := cpuTime()
+			for i := 0; i < b.N; i++ {
+				resp, err := http.Get(srv.URL)
+				if err != nil {
+					b.Fatal(err)
+				}
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			b.ReportMetric(float64(cpuTime()-start)/float64(b.N), "cpu-ns/op")
+		})
+	}
+}
+
+// The ResponseWriter of the in-memory client of BenchmarkHit, it counts the
+// body and drops it
+type benchWriter struct {
+	header http.Header
+	status int
+	n      int64
+}
+
+func (w *benchWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *benchWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *benchWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// Serves cache hits through the proxy handlers, from a temporary cache
+// directory, for a few blob sizes and numbers of concurrent clients. The
+// requests do not go through a socket: it measures the cache, not the
+// network stack. Run it with -benchmem for the allocations; ns/op is the
+// throughput, latency-ns the mean time of a hit seen by one client.
+func BenchmarkHit(b *testing.B) {
+	for _, size := range []int64{1 << 10, 1 << 20, 100 << 20} {
+		blob := make([]byte, size)
+		rand.Read(blob)
+		sum := sha256.Sum256(blob)
+		shaname := hex.EncodeToString(sum[:])
+
+		proxy := goproxy.NewProxyHttpServer()
+		c, err := RegisterCache(proxy, Config{Dir: b.TempDir()})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := c.mkdirFor(c.blobPath(shaname)); err != nil {
+			b.Fatal(err)
+		}
+		if err := ioutil.WriteFile(c.blobPath(shaname), blob, 0644); err != nil {
+			b.Fatal(err)
+		}
+		c.BeginFetch(shaname)
+		c.CompleteFetch(shaname, blobInfo{size: size, diskSize: size, contentType: "application/octet-stream"})
+		u := "http://registry.test/v2/library/test/blobs/sha256:" + shaname
+
+		for _, clients := range []int{1, 8, 64} {
+			b.Run(fmt.Sprintf("%s/clients=%d", byteSize(size), clients), func(b *testing.B) {
+				b.SetBytes(size)
+				b.ReportAllocs()
+				var next, busy int64
+				var wg sync.WaitGroup
+				b.ResetTimer()
+				for i := 0; i < clients; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for atomic.AddInt64(&next, 1) <= int64(b.N) {
+							req, _ := http.NewRequest("GET", u, nil)
+							w := &benchWriter{header: make(http.Header)}
+							start := time.Now()
+							proxy.ServeHTTP(w, req)
+							atomic.AddInt64(&busy, int64(time.Since(start)))
+							if w.n != size {
+								b.Errorf("hit returned %d bytes (status %d)", w.n, w.status)
+								return
+							}
+						}
+					}()
+				}
+				wg.Wait()
+				b.ReportMetric(float64(busy)/float64(b.N), "latency-ns")
+			})
+		}
+	}
+}
+
+func byteSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%dMB", n>>20)
+	case n >= 1<<10:
+		return fmt.Sprintf("%dKB", n>>10)
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Some registries send the blobs chunked, without a Content-Length. The image
+// manifests going through the proxy list the size of their blobs: it is
+// remembered so that such a download can still be checked for truncation, and
+// a Content-Length which does not match the manifest is not trusted either.
+// Without a known size only the digest tells a short download, see tee.go.
+
+// Bound of the remembered sizes, arbitrary ones are dropped when it is reached
+const maxBlobSizes = 16384
+
+type manifestBlob struct {
+	MediaType string
+	Digest    string
+	Size      int64
+}
+
+// Remembers the size of the blobs listed by the manifest body of host
+func (c *Cache) learnBlobSizes(host string, body []byte) {
+	var manifest imageManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return
+	}
+	c.sm.Lock()
+	defer c.sm.Unlock()
+	for _, blob := range append(manifest.Layers, manifest.Config) {
+		shaname := strings.TrimPrefix(blob.Digest, "sha256:")
+		if !blobNameRe.MatchString(shaname) || blob.Size <= 0 {
+			continue
+		}
+		if len(c.sizes) >= maxBlobSizes {
+			for k := range c.sizes {
+				delete(c.sizes, k)
+				break
+			}
+		}
+		c.sizes[c.blobKey(host, shaname)] = blob.Size
+	}
+}
+
+// Returns the size of a blob listed by a manifest, false if none listed it
+func (c *Cache) manifestSize(shaname string) (int64, bool) {
+	c.sm.Lock()
+	defer c.sm.Unlock()
+	size, ok := c.sizes[shaname]
+	return size, ok
+}
@@ -0,0 +1,126 @@
+package cache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// When Config.Secondary can list its blobs, a bloom filter of their digests
+// is built at startup, rebuilt by RefreshSecondaryKeysEvery and updated on
+// every upload. It only answers "probably yes": a blob it knows is not
+// uploaded again, without asking the secondary tier. A blob it does not know
+// may have been uploaded by another node since the filter was built, so it is
+// still looked up there before a download and before an upload. A false
+// positive, or a blob deleted from the secondary tier behind the back of the
+// cache, is not uploaded by this node until the next rebuild.
+
+const (
+	bloomBitsPerKey = 10 // about 1% of false positives with bloomHashes
+	bloomHashes     = 7
+	bloomMinKeys    = 100000
+)
+
+// Implemented by the stores which can list their blobs
+type BlobLister interface {
+	List(fn func(shaname string)) error
+}
+
+type bloomFilter struct {
+	mu   sync.RWMutex
+	bits []uint64
+}
+
+// Sized for twice keys, bloomMinKeys at least, to keep room for the uploads
+func newBloomFilter(keys int) *bloomFilter {
+	if keys < bloomMinKeys/2 {
+		keys = bloomMinKeys / 2
+	}
+	return &bloomFilter{bits: make([]uint64, (2*keys*bloomBitsPerKey+63)/64)}
+}
+
+// Double hashing of the two halves of a 128 bits FNV-1a
+func (f *bloomFilter) positions(key string) [bloomHashes]uint64 {
+	h := fnv.New128a()
+	h.Write([]byte(key))
+	sum := h.Sum(nil)
+	h1, h2 := binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:])
+	n := uint64(len(f.bits) * 64)
+	var pos [bloomHashes]uint64
+	for i := range pos {
+		pos[i] = (h1 + uint64(i)*h2) % n
+	}
+	return pos
+}
+
+// Replaces the content of f by the content of g
+func (f *bloomFilter) replace(g *bloomFilter) {
+	f.mu.Lock()
+	f.bits = g.bits
+	f.mu.Unlock()
+}
+
+func (f *bloomFilter) add(key string) {
+	pos := f.positions(key)
+	f.mu.Lock()
+	for _, p := range pos {
+		f.bits[p/64] |= 1 << (p % 64)
+	}
+	f.mu.Unlock()
+}
+
+// False means that key was never added
+func (f *bloomFilter) mayContain(key string) bool {
+	pos := f.positions(key)
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, p := range pos {
+		if f.bits[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Lists Config.Secondary into a new c.secondaryKeys at startup, which stays
+// nil if it cannot be listed; into the existing one afterwards
+func (c *Cache) loadSecondaryKeys() {
+	lister, ok := c.cfg.Secondary.(BlobLister)
+	if !ok {
+		return
+	}
+	var keys []string
+	if err := lister.List(func(shaname string) { keys = append(keys, shaname) }); err != nil {
+		fmt.Printf("Cannot list the secondary cache: %s\n", err)
+		return
+	}
+	filter := newBloomFilter(len(keys))
+	for _, key := range keys {
+		filter.add(key)
+	}
+	fmt.Printf("%d blobs in the secondary cache\n", len(keys))
+	if c.secondaryKeys == nil {
+		c.secondaryKeys = filter
+	} else {
+		c.secondaryKeys.replace(filter)
+	}
+}
+
+// Rebuilds the filter of the secondary tier, which must be built by NewCache
+func (c *Cache) RefreshSecondaryKeysEvery(period time.Duration) {
+	if c.secondaryKeys == nil {
+		return
+	}
+	ticker := c.cfg.Clock.NewTicker(period)
+	defer ticker.Stop()
+	for range ticker.Chan() {
+		c.loadSecondaryKeys()
+	}
+}
+
+// Returns true if the secondary tier probably has the blob
+func (c *Cache) probablyInSecondary(shaname string) bool {
+	return c.secondaryKeys != nil && c.secondaryKeys.mayContain(shaname)
+}
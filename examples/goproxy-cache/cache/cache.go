@@ -0,0 +1,514 @@
+// Package cache is a goproxy extension caching the blobs and manifests pulled
+// from container registries. RegisterCache adds it to a proxy, the
+// goproxy-cache example is a ready to use server.
+package cache
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	// Constants for cache entry status
+	EMPTY       = 0
+	AVAILABLE   = 1
+	IN_PROGRESS = 2
+	FAILED      = 3 // the last download failed, retried after Config.FailureCooldown
+)
+
+// Blob URL patterns, the digest is captured by the shaname group
+var defaultBlobRegexps = []string{
+	// OCI distribution spec, any registry
+	"/v2/.+/blobs/sha256:(?P<shaname>[a-f0-9]{64})$",
+	// Docker Hub redirects blob downloads to this storage layout
+	"/registry-v2/docker/registry/v2/blobs/sha256/../(?P<shaname>[a-f0-9]{64})/",
+	// GCR and Artifact Registry redirect to Google Cloud Storage
+	"^/[^/]+/containers/images/sha256:(?P<shaname>[a-f0-9]{64})$",
+	// ghcr.io redirects to its package storage
+	"^/ghcr1/blobs/sha256:(?P<shaname>[a-f0-9]{64})$",
+}
+
+// Settings of a Cache
+type Config struct {
+	Dir                  string            // where the blobs are stored
+	ReadDirs             []string          // read-only directories where the blobs missing from Dir are looked up, see readdir.go
+	DirMode              os.FileMode       // mode of the cache directories, 0755 if 0
+	FileMode             os.FileMode       // mode of the cache files, 0644 if 0
+	NoCache              bool              // pass-through mode: the handlers only log, for debugging
+	NamespaceByHost      bool              // key the blobs by upstream host and digest, see shard.go
+	VerifyOnStart        bool              // hash every blob at startup and quarantine the bad ones
+	VerifyWorkers        int               // concurrent hashing of VerifyOnStart, the number of CPUs if 0
+	NoVerifyDigest       bool              // store the downloads without checking their sha256, only their size, see tee.go
+	MaxSize              int64             // maximum size of the cache, 0 means unlimited
+	MaxEntries           int               // maximum number of cached blobs, 0 means unlimited
+	MaxBlobSize          int64             // blobs bigger than this are not cached, 0 means unlimited
+	MinBlobSize          int64             // blobs smaller than this are not cached, they are cheap to fetch again
+	MirrorPushes         bool              // cache the blobs pushed through the proxy, see push.go
+	InlineBlobSize       int64             // blobs up to this size are stored in a database, not in files, 0 disables it, see inline.go
+	EvictPolicy          string            // which blobs are evicted first, EvictLRU if empty, see evict.go
+	DiskReserve          int64             // free bytes kept on the cache filesystem, 0 means no check
+	Compress             bool              // store the blobs gzipped when it saves space
+	WriteBuffer          int64             // bytes of a download queued for a background disk writer, 0 means synchronous writes
+	ServeRateLimit       int64             // bytes per second served from the cache by all the hits, 0 means unlimited
+	ManifestTTL          time.Duration     // how long manifests pulled by tag are cached
+	ManifestRevalidate   bool              // revalidate expired tags with If-None-Match, some registries get 304 wrong
+	CatalogTTL           time.Duration     // how long /v2/_catalog answers are cached, 0 disables it, see catalog.go
+	PrefetchLayers       bool              // pull the missing blobs of a manifest in the background, see prefetch.go
+	ServeStaleOnError    bool              // serve an expired manifest when the upstream is unavailable
+	MaxConcurrentFetches int               // concurrent blob fetches from the upstream, 0 means unlimited
+	FetchRetries         int               // retries of a blob fetch failing with a transient error
+	FetchTimeout         time.Duration     // deadline of a blob fetch with its retries and body, 0 means none
+	NegativeTTL          time.Duration     // how long an upstream 404 of a blob is served locally, 0 disables it
+	FailureCooldown      time.Duration     // how long a blob whose download failed is only passed through, 0 retries at once
+	BlobRegexps          []string          // additional blob URL patterns with a (?P<shaname>...) group
+	AllowMediaTypes      []string          // only these blob media types are cached if set, see mediatype.go
+	DenyMediaTypes       []string          // blob media types never cached, in addition to the default ones
+	Secondary            BlobStore         // optional shared tier checked on a local miss
+	Peers                []string          // base URLs of other proxies asked for a blob before the upstream, see peer.go
+	PeerTimeout          time.Duration     // how long a peer has to answer, 2s if 0
+	Upstream             http.RoundTripper // transport of the blob downloads, usually the proxy one
+	MirrorMap            map[string]string // upstream host to the host actually requested, see mirrormap.go
+	ReadyCheckURL        string            // checked by /_cache/readyz, no check if empty
+	AccessLog            io.Writer         // gets a Combined Log Format line per response if set, see OpenAccessLog
+	OnEvict              EvictFunc         // called for every blob removed from the cache if set
+	HitHeaders           http.Header       // added to the responses served from the cache, see headers.go
+	Pinned               []string          // [host/]sha256:<hex> digests of the blobs never evicted, see pin.go
+	Connections          func() int64      // current client connections, shown by /stats if set
+	Clock                Clock             // time of the TTLs and of the eviction, the real time if nil, see clock.go
+	Tracer               trace.Tracer      // spans of the requests, none if nil, see trace.go
+}
+
+// A blob cache: the blobs are named by their sha256 digest and stored in Dir
+type Cache struct {
+	cfg     Config
+	dir     string // cfg.Dir, ending with a /
+	blobRes []*regexp.Regexp
+
+	mu        sync.RWMutex
+	entries   map[string]*cacheEntry // by cache key, see blobKey
+	totalSize int64                  // disk bytes of AVAILABLE entries, protected by mu
+	available int                    // number of AVAILABLE entries, protected by mu
+	pinned    map[string]bool        // by cache key, never evicted, protected by mu, see pin.go
+
+	mm        sync.RWMutex
+	manifests map[string]*manifestEntry
+
+	cm       sync.Mutex
+	catalogs map[string]*catalogEntry
+
+	nm        sync.Mutex
+	negatives map[string]time.Time // expiry of the upstream 404s by URL, see negative.go
+
+	sm    sync.Mutex
+	sizes map[string]int64 // by cache key, as listed by the manifests, see blobsize.go
+
+	// The settings changed by Reload, see reload.go
+	rm           sync.RWMutex
+	mirrors      map[string]string // Config.MirrorMap
+	serveLimiter *rateLimiter      // paces the cache hits, nil means unlimited
+
+	// The local disk, always used as the first tier
+	local BlobStore
+	// Bounds the concurrent upstream fetches of blobs, nil means unlimited
+	fetchSlots chan struct{}
+	// Connections to the Config.Peers
+	peers *http.Transport
+	// The proxy of RegisterCache, the prefetches go through it
+	proxy http.Handler
+	// The inline blobs, nil without Config.InlineBlobSize
+	db *bolt.DB
+	// Digests of Config.Secondary, nil if it cannot be listed, see bloom.go
+	secondaryKeys *bloomFilter
+	stats         cacheStats
+}
+
+// What is known about an AVAILABLE blob
+type blobInfo struct {
+	size          int64     // original size, served as Content-Length
+	diskSize      int64     // bytes used on disk, less than size if compressed
+	compressed    bool      // the file is gzipped
+	private       bool      // fetched with credentials, see auth.go
+	contentType   string    // upstream Content-Type
+	contentDigest string    // upstream Docker-Content-Digest
+	inline        bool      // stored in the database of inline.go, not in a file
+	readDir       string    // read-only directory of the file, Dir if empty, see readdir.go
+	stored        time.Time // when the blob was cached, the mtime of its file after a restart
+}
+
+// A cache entry; waiters block on cond (bound to mu) until status leaves IN_PROGRESS
+type cacheEntry struct {
+	blobInfo
+	status  int
+	cond    *sync.Cond
+	atime   time.Time // last access, used for LRU eviction
+	hits    int64     // cache hits, used for LFU eviction, updated with sync/atomic
+	retry   time.Time // end of the cooldown of a FAILED blob
+	readers int       // requests reading the blob, see acquire
+}
+
+// Creates the cache directory if needed and loads the blobs it contains
+func NewCache(cfg Config) (*Cache, error) {
+	if cfg.DirMode == 0 {
+		cfg.DirMode = DefaultDirMode
+	}
+	if cfg.FileMode == 0 {
+		cfg.FileMode = DefaultFileMode
+	}
+	switch cfg.EvictPolicy {
+	case "":
+		cfg.EvictPolicy = EvictLRU
+	case EvictLRU, EvictLFU:
+	default:
+		return nil, fmt.Errorf("invalid eviction policy %q, expected %s or %s", cfg.EvictPolicy, EvictLRU, EvictLFU)
+	}
+	if cfg.VerifyWorkers <= 0 {
+		cfg.VerifyWorkers = runtime.NumCPU()
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = realClock{}
+	}
+	if cfg.Tracer == nil {
+		cfg.Tracer = noop.NewTracerProvider().Tracer("")
+	}
+	c := &Cache{
+		cfg:       cfg,
+		dir:       cfg.Dir,
+		mirrors:   cfg.MirrorMap,
+		entries:   make(map[string]*cacheEntry),
+		manifests: make(map[string]*manifestEntry),
+		negatives: make(map[string]time.Time),
+		catalogs:  make(map[string]*catalogEntry),
+		sizes:     make(map[string]int64),
+	}
+	// Even without a mirror map, one can be set by Reload
+	if cfg.Upstream != nil {
+		c.cfg.Upstream = &mirrorTransport{cfg.Upstream, c}
+	}
+	// Assume the directory ends with a /
+	if !strings.HasSuffix(c.dir, "/") {
+		c.dir = c.dir + "/"
+	}
+	c.cfg.ReadDirs = nil
+	for _, dir := range cfg.ReadDirs {
+		if !strings.HasSuffix(dir, "/") {
+			dir = dir + "/"
+		}
+		c.cfg.ReadDirs = append(c.cfg.ReadDirs, dir)
+	}
+	c.local = localStore{dir: c.dir, dirMode: cfg.DirMode, fileMode: cfg.FileMode}
+	if cfg.MaxConcurrentFetches > 0 {
+		c.fetchSlots = make(chan struct{}, cfg.MaxConcurrentFetches)
+	}
+	if len(cfg.Peers) > 0 {
+		if c.cfg.PeerTimeout <= 0 {
+			c.cfg.PeerTimeout = defaultPeerTimeout
+		}
+		c.peers = newPeerTransport(c.cfg.PeerTimeout)
+	}
+	if cfg.ServeRateLimit > 0 {
+		c.serveLimiter = newRateLimiter(cfg.ServeRateLimit)
+	}
+
+	for _, expr := range append(defaultBlobRegexps, cfg.BlobRegexps...) {
+		if err := c.addBlobRegexp(expr); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.pinAll(cfg.Pinned); err != nil {
+		return nil, err
+	}
+
+	if cfg.Secondary != nil {
+		c.loadSecondaryKeys()
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Adds a blob pattern, it must capture the digest in a shaname group
+func (c *Cache) addBlobRegexp(expr string) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("invalid blob regexp %q: %v", expr, err)
+	}
+	if re.SubexpIndex("shaname") < 0 {
+		return fmt.Errorf("regexp %q has no (?P<shaname>...) group", expr)
+	}
+	c.blobRes = append(c.blobRes, re)
+	return nil
+}
+
+func (c *Cache) load() error {
+	if stat, err := os.Stat(c.dir); err != nil || !stat.IsDir() {
+		fmt.Printf("Directory %s does not exists - try to create it\n", c.dir)
+		if err := mkdirMode(c.dir, c.cfg.DirMode); err != nil {
+			fmt.Printf("Cannot create directory %s\n", c.dir)
+			return err
+		}
+	} else {
+		fmt.Printf("Directory %s exists\n", c.dir)
+	}
+	if err := checkDirAccess(c.dir); err != nil {
+		return err
+	}
+
+	if err := c.migrate(); err != nil {
+		fmt.Printf("Cannot migrate %s to the layout version %d\n", c.dir, layoutVersion)
+		return err
+	}
+
+	if err := c.removeTempFiles(); err != nil {
+		return err
+	}
+	c.removeUploads()
+
+	// Load the cache
+	files, err := c.listBlobs()
+	if err != nil {
+		return err
+	}
+
+	var verified []verifyResult
+	if c.cfg.VerifyOnStart {
+		verified = c.verifyAll(files)
+	}
+
+	index := c.loadIndex()
+	for i, file := range files {
+		fmt.Printf("cache: %s\n", file.key)
+
+		meta, indexed := indexEntry{}, false
+		if index != nil {
+			meta, indexed = index.Blobs[file.key]
+		}
+		if verified != nil {
+			if verified[i].err != nil {
+				continue
+			}
+			// The index is only trusted for what hashing cannot tell
+			if !indexed || meta.diskSize() != file.Size() {
+				meta = indexEntry{Atime: file.ModTime()}
+			}
+			info := verified[i].info
+			meta.Size, meta.DiskSize, meta.Compressed = info.size, info.diskSize, info.compressed
+		} else if !indexed || meta.diskSize() != file.Size() {
+			info, err := verifyBlob(c.blobPath(file.key), digestOf(file.key))
+			if err != nil {
+				fmt.Printf("Discard %s: %s\n", file.key, err)
+				os.Remove(c.blobPath(file.key))
+				continue
+			}
+			meta = indexEntry{Size: info.size, DiskSize: info.diskSize, Compressed: info.compressed, Atime: file.ModTime()}
+		}
+
+		entry := c.getEntry(file.key)
+		entry.status = AVAILABLE
+		entry.size = meta.Size
+		entry.diskSize = file.Size()
+		entry.compressed = meta.Compressed
+		entry.private = meta.Private
+		entry.atime = meta.Atime
+		entry.hits = meta.Hits
+		entry.contentType = meta.ContentType
+		entry.contentDigest = meta.ContentDigest
+		entry.stored = file.ModTime()
+		c.totalSize += entry.diskSize
+		c.available++
+	}
+	if c.cfg.InlineBlobSize > 0 {
+		if err := c.openInlineDB(); err != nil {
+			return err
+		}
+		if err := c.loadInline(index); err != nil {
+			return err
+		}
+	}
+	c.evict("")
+	return nil
+}
+
+// Check that the content of fname matches its sha256 digest shaname. A file
+// which does not match may be a compressed blob, it is then checked gunzipped.
+func verifyBlob(fname string, shaname string) (blobInfo, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return blobInfo{}, err
+	}
+	defer f.Close()
+	return verifyReader(f, shaname)
+}
+
+// Same as verifyBlob for the content of r
+func verifyReader(f io.ReadSeeker, shaname string) (blobInfo, error) {
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return blobInfo{}, err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	if digest == shaname {
+		return blobInfo{size: size, diskSize: size}, nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return blobInfo{}, err
+	}
+	if gz, err := gzip.NewReader(f); err == nil {
+		h.Reset()
+		n, err := io.Copy(h, gz)
+		if err == nil && hex.EncodeToString(h.Sum(nil)) == shaname {
+			return blobInfo{size: n, diskSize: size, compressed: true}, nil
+		}
+	}
+	return blobInfo{}, fmt.Errorf("digest mismatch (computed=%s)", digest)
+}
+
+// Returns the entry for shaname, creating an EMPTY one if needed. c.mu must be held.
+func (c *Cache) getEntry(shaname string) *cacheEntry {
+	entry, ok := c.entries[shaname]
+	if !ok {
+		entry = &cacheEntry{status: EMPTY, cond: sync.NewCond(&c.mu)}
+		c.entries[shaname] = entry
+	}
+	return entry
+}
+
+// Changes the status of an entry and wakes up all its waiters. c.mu must be held.
+func (c *Cache) setStatus(shaname string, status int) {
+	entry := c.getEntry(shaname)
+	entry.status = status
+	entry.cond.Broadcast()
+}
+
+// Waits while the blob is IN_PROGRESS, or until ctx is done. Returns true with
+// the blob metadata if it is AVAILABLE; false if it is EMPTY and the caller may
+// fetch it with BeginFetch, if it is FAILED, or if ctx is done.
+func (c *Cache) Get(ctx context.Context, shaname string) (info blobInfo, ok bool, waited time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.getEntry(shaname)
+
+	if entry.status == IN_PROGRESS {
+		atomic.AddInt64(&c.stats.Waits, 1)
+		// A cancelled request wakes up the waiters so that it can give up: its
+		// client went away, a MITM'd one included, see watchClient in https.go.
+		stop := context.AfterFunc(ctx, func() {
+			c.mu.Lock()
+			entry.cond.Broadcast()
+			c.mu.Unlock()
+		})
+		defer stop()
+
+		start := time.Now()
+		atomic.AddInt64(&c.stats.Waiting, 1)
+		for entry.status == IN_PROGRESS && ctx.Err() == nil {
+			entry.cond.Wait()
+		}
+		atomic.AddInt64(&c.stats.Waiting, -1)
+		waited = time.Since(start)
+		c.stats.WaitTime.observe(waited)
+	}
+
+	if entry.status != AVAILABLE || ctx.Err() != nil {
+		return blobInfo{}, false, waited
+	}
+	entry.atime = c.cfg.Clock.Now()
+	return entry.blobInfo, true, waited
+}
+
+// Marks an EMPTY blob IN_PROGRESS: the caller becomes its downloader and must
+// end with CompleteFetch or CancelFetch. Returns false if the blob is not EMPTY.
+func (c *Cache) BeginFetch(shaname string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.getEntry(shaname)
+	if entry.status != EMPTY {
+		return false
+	}
+	entry.status = IN_PROGRESS
+	return true
+}
+
+// Marks a downloaded blob AVAILABLE, its file must be complete and verified.
+// Returns info as stored: a small blob may have moved to the inline store.
+func (c *Cache) CompleteFetch(shaname string, info blobInfo) blobInfo {
+	c.inline(shaname, &info)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.markAvailable(shaname, info)
+	c.evict(shaname)
+	return info
+}
+
+// Resets a blob to EMPTY after a download that won't be cached: one of the
+// waiters can take over the download
+func (c *Cache) CancelFetch(shaname string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setStatus(shaname, EMPTY)
+}
+
+// Marks a blob FAILED after a download broken by the upstream: the waiters
+// give up, and until Config.FailureCooldown elapses the requests are passed
+// through rather than retrying the download. Same as CancelFetch without a
+// cooldown.
+func (c *Cache) FailFetch(shaname string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cfg.FailureCooldown <= 0 {
+		c.setStatus(shaname, EMPTY)
+		return
+	}
+	c.getEntry(shaname).retry = c.cfg.Clock.Now().Add(c.cfg.FailureCooldown)
+	c.setStatus(shaname, FAILED)
+}
+
+// Returns true if the last download of the blob failed less than
+// Config.FailureCooldown ago. A FAILED blob whose cooldown is over goes back
+// to EMPTY so that the next request fetches it again.
+func (c *Cache) coolingDown(shaname string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.getEntry(shaname)
+	if entry.status != FAILED {
+		return false
+	}
+	if c.cfg.Clock.Now().Before(entry.retry) {
+		return true
+	}
+	entry.status = EMPTY
+	return false
+}
+
+func (c *Cache) cacheExistsFor(blob string) bool {
+	if c.db != nil {
+		if _, err := c.readInline(blob); err == nil {
+			return true
+		}
+	}
+	fname := c.blobPath(blob)
+	if _, err := os.Stat(fname); os.IsNotExist(err) {
+		return c.inReadDirs(blob)
+	}
+
+	return true
+}
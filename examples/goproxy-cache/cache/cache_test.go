@@ -0,0 +1,831 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testBlob = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func newTestCache(t *testing.T) *Cache {
+	return newTestCacheIn(t, t.TempDir())
+}
+
+func newTestCacheIn(t *testing.T, dir string) *Cache {
+	c, err := NewCache(Config{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestFetchLifecycle(t *testing.T) {
+	c := newTestCache(t)
+
+	if _, ok, _ := c.Get(context.Background(), testBlob); ok {
+		t.Fatal("empty cache should miss")
+	}
+	if !c.BeginFetch(testBlob) {
+		t.Fatal("BeginFetch on an EMPTY entry should succeed")
+	}
+	if c.BeginFetch(testBlob) {
+		t.Fatal("BeginFetch on an IN_PROGRESS entry should fail")
+	}
+
+	done := make(chan blobInfo)
+	go func() {
+		info, ok, _ := c.Get(context.Background(), testBlob)
+		if !ok {
+			t.Error("waiter should get the completed blob")
+		}
+		done <- info
+	}()
+	c.CompleteFetch(testBlob, blobInfo{size: 42, contentType: "application/octet-stream"})
+
+	select {
+	case info := <-done:
+		if info.size != 42 || info.contentType != "application/octet-stream" {
+			t.Errorf("unexpected blob info %+v", info)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter not woken up by CompleteFetch")
+	}
+	if c.BeginFetch(testBlob) {
+		t.Fatal("BeginFetch on an AVAILABLE entry should fail")
+	}
+}
+
+func TestCancelFetchWakesWaiters(t *testing.T) {
+	c := newTestCache(t)
+	c.BeginFetch(testBlob)
+
+	done := make(chan bool)
+	go func() {
+		_, ok, _ := c.Get(context.Background(), testBlob)
+		done <- ok
+	}()
+	c.CancelFetch(testBlob)
+
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("cancelled fetch should not be a hit")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter not woken up by CancelFetch")
+	}
+	if !c.BeginFetch(testBlob) {
+		t.Fatal("a waiter should be able to take over a cancelled fetch")
+	}
+}
+
+func TestGetGivesUpWhenContextDone(t *testing.T) {
+	c := newTestCache(t)
+	c.BeginFetch(testBlob)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, ok, waited := c.Get(ctx, testBlob); ok || waited == 0 {
+		t.Fatalf("Get should wait then give up, got ok=%v waited=%s", ok, waited)
+	}
+
+	// A client going away cancels its request
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, ok, waited := c.Get(ctx, testBlob); ok || waited > 5*time.Second {
+		t.Fatalf("Get should give up once cancelled, got ok=%v waited=%s", ok, waited)
+	}
+}
+
+func TestBlobList(t *testing.T) {
+	c := newTestCache(t)
+	small, big := testBlob, strings.Repeat("a", 64)
+	for _, b := range []struct {
+		shaname string
+		size    int64
+	}{{big, 100}, {small, 10}} {
+		c.BeginFetch(b.shaname)
+		c.CompleteFetch(b.shaname, blobInfo{size: b.size, diskSize: b.size})
+	}
+	c.BeginFetch(strings.Repeat("0", 64))
+
+	list := func(query string) []listedBlob {
+		w := httptest.NewRecorder()
+		c.AdminHandler(true).ServeHTTP(w, httptest.NewRequest("GET", "/_cache/blobs"+query, nil))
+		if w.Code != 200 {
+			t.Fatalf("GET %s: %d %s", query, w.Code, w.Body)
+		}
+		var blobs []listedBlob
+		if err := json.Unmarshal(w.Body.Bytes(), &blobs); err != nil {
+			t.Fatal(err)
+		}
+		return blobs
+	}
+
+	if blobs := list(""); len(blobs) != 3 || blobs[0].Status != "in_progress" {
+		t.Fatalf("unexpected listing %+v", blobs)
+	}
+	if blobs := list("?sort=size&limit=1"); len(blobs) != 1 || blobs[0].Digest != "sha256:"+big {
+		t.Fatalf("expected the biggest blob, got %+v", blobs)
+	}
+	// The small blob was completed last
+	if blobs := list("?sort=atime"); blobs[len(blobs)-1].Digest != "sha256:"+small {
+		t.Fatalf("expected the most recent blob last, got %+v", blobs)
+	}
+}
+
+func TestVerifyOnStartQuarantines(t *testing.T) {
+	dir := t.TempDir()
+	bad := strings.Repeat("a", 64)
+	for shaname, content := range map[string]string{testBlob: "", bad: "not the content of its digest"} {
+		fname := shardPath(dir+"/", shaname)
+		os.MkdirAll(filepath.Dir(fname), 0755)
+		if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := NewCache(Config{Dir: dir, VerifyOnStart: true, VerifyWorkers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := c.Get(context.Background(), testBlob); !ok {
+		t.Error("the good blob should be loaded")
+	}
+	if _, ok, _ := c.Get(context.Background(), bad); ok {
+		t.Error("the bad blob should not be loaded")
+	}
+	if _, err := os.Stat(dir + "/" + quarantineDir + "/" + bad); err != nil {
+		t.Errorf("the bad blob should be quarantined: %s", err)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestWriteBehindError(t *testing.T) {
+	wb := newWriteBehind(failingWriter{}, 0)
+	for i := 0; i < 10; i++ {
+		wb.Write([]byte("chunk"))
+	}
+	if err := wb.Close(); err == nil {
+		t.Fatal("the write error should be returned by Close")
+	}
+}
+
+func TestMediaTypeCached(t *testing.T) {
+	c := newTestCache(t)
+	for ct, cached := range map[string]bool{
+		"application/octet-stream": true,
+		"":                         true,
+		"application/vnd.oci.image.layer.v1.tar+gzip":               true,
+		"application/vnd.in-toto+json; charset=utf-8":               false,
+		"application/vnd.dev.sigstore.bundle.v0.3+json":             false,
+		"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip": false,
+	} {
+		if c.mediaTypeCached(ct) != cached {
+			t.Errorf("%q cached=%v, expected %v", ct, !cached, cached)
+		}
+	}
+
+	c.cfg.AllowMediaTypes = []string{"application/vnd.in-toto+json"}
+	c.cfg.DenyMediaTypes = []string{"application/octet-stream"}
+	if !c.mediaTypeCached("application/vnd.in-toto+json") || c.mediaTypeCached("application/vnd.oci.image.layer.v1.tar") {
+		t.Error("only the allowed types should be cached")
+	}
+	if c.mediaTypeCached("application/octet-stream") {
+		t.Error("a denied type should not be cached")
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	c, err := NewCache(Config{Dir: t.TempDir(), MaxEntries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := []string{strings.Repeat("1", 64), strings.Repeat("2", 64), strings.Repeat("3", 64)}
+	for _, shaname := range blobs {
+		c.BeginFetch(shaname)
+		c.CompleteFetch(shaname, blobInfo{size: 1, diskSize: 1})
+	}
+	if c.available != 2 {
+		t.Fatalf("expected 2 entries, got %d", c.available)
+	}
+	if c.entries[blobs[0]] != nil {
+		t.Fatal("the least recently used blob should be evicted")
+	}
+}
+
+func TestOnEvict(t *testing.T) {
+	var evicted []string
+	c, err := NewCache(Config{Dir: t.TempDir(), MaxEntries: 1, NamespaceByHost: true, OnEvict: func(digest string, size int64) {
+		evicted = append(evicted, digest)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, shaname := range []string{strings.Repeat("1", 64), strings.Repeat("2", 64)} {
+		key := c.blobKey("registry.example.com", shaname)
+		c.BeginFetch(key)
+		c.CompleteFetch(key, blobInfo{size: 1, diskSize: 1})
+	}
+	c.purgeAll()
+	want := []string{"registry.example.com/sha256:" + strings.Repeat("1", 64), "registry.example.com/sha256:" + strings.Repeat("2", 64)}
+	if len(evicted) != 2 || evicted[0] != want[0] || evicted[1] != want[1] {
+		t.Fatalf("expected %q to be evicted, got %q", want, evicted)
+	}
+}
+
+func TestEvictLFU(t *testing.T) {
+	c, err := NewCache(Config{Dir: t.TempDir(), MaxEntries: 2, EvictPolicy: EvictLFU})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := []string{strings.Repeat("1", 64), strings.Repeat("2", 64), strings.Repeat("3", 64)}
+	for _, shaname := range blobs {
+		c.BeginFetch(shaname)
+		c.CompleteFetch(shaname, blobInfo{size: 1, diskSize: 1})
+		if shaname == blobs[0] {
+			c.countHit(shaname)
+		}
+	}
+	if c.entries[blobs[0]] == nil || c.entries[blobs[1]] != nil || c.entries[blobs[2]] == nil {
+		t.Fatal("the blob without hits should be evicted, not the new one")
+	}
+}
+
+func TestHitsArePersisted(t *testing.T) {
+	dir := t.TempDir()
+	fname := shardPath(dir+"/", testBlob)
+	os.MkdirAll(filepath.Dir(fname), 0755)
+	if err := ioutil.WriteFile(fname, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestCacheIn(t, dir)
+	c.countHit(testBlob)
+	c.countHit(testBlob)
+	if err := c.saveIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	c = newTestCacheIn(t, dir)
+	if blobs := c.blobList(); len(blobs) != 1 || blobs[0].Hits != 2 {
+		t.Fatalf("expected 2 hits after a restart, got %+v", blobs)
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	defer func(level LogLevel) { atomic.StoreInt32(&logLevel, int32(level)) }(CurrentLogLevel())
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Fatal("verbose is not a log level")
+	}
+	var buf bytes.Buffer
+	w := levelWriter{&buf}
+	for _, name := range []string{"error", "warn"} {
+		level, _ := ParseLogLevel(name)
+		atomic.StoreInt32(&logLevel, int32(level))
+		w.Write([]byte("2026/01/01 00:00:00 [001] WARN: " + name + "\n"))
+	}
+	if buf.String() != "2026/01/01 00:00:00 [001] WARN: warn\n" {
+		t.Fatalf("the warnings should only be written at warn, got %q", buf.String())
+	}
+	buf.Reset()
+	for _, name := range []string{"info", "debug"} {
+		level, _ := ParseLogLevel(name)
+		atomic.StoreInt32(&logLevel, int32(level))
+		w.Write([]byte("2026/01/01 00:00:00 [001] INFO: " + name + "\n"))
+	}
+	if buf.String() != "2026/01/01 00:00:00 [001] INFO: debug\n" {
+		t.Fatalf("the debug lines should only be written at debug, got %q", buf.String())
+	}
+	if line := textEvent(nil, "hit", testBlob, "HIT", []interface{}{"bytes", 12}); line != "[000] HIT: hit "+testBlob+" bytes=12" {
+		t.Fatalf("unexpected event line %q", line)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1 << 20)
+	start := time.Now()
+	// The burst is free, the next 256KB take about 250ms
+	l.wait(int(l.burst))
+	for i := 0; i < 8; i++ {
+		l.wait(writeBehindChunk)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("256KB over the burst at 1MB/s took %s", d)
+	}
+}
+
+func TestHitBodyFlushes(t *testing.T) {
+	blob := strings.Repeat("x", 3*serveChunkSize+1)
+	var served int64
+	body := &hitBody{ioutil.NopCloser(strings.NewReader(blob)), nil, &served, nil}
+
+	w := httptest.NewRecorder()
+	n, err := io.Copy(w, body)
+	if err != nil || n != int64(len(blob)) || w.Body.String() != blob {
+		t.Fatalf("copied %d bytes, err=%v", n, err)
+	}
+	if !w.Flushed || served != int64(len(blob)) {
+		t.Fatalf("flushed=%v served=%d", w.Flushed, served)
+	}
+}
+
+func TestLayoutVersion(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, testBlob), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestCacheIn(t, dir)
+	if _, ok, _ := c.Get(context.Background(), testBlob); !ok {
+		t.Fatal("blob of the flat layout not migrated")
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, versionName)); string(data) != "1\n" {
+		t.Fatalf("unexpected version marker %q", data)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, versionName), []byte("99\n"), 0644)
+	if _, err := NewCache(Config{Dir: dir}); err == nil {
+		t.Fatal("a cache of a newer layout version must be refused")
+	}
+}
+
+func TestWaitStats(t *testing.T) {
+	c := newTestCache(t)
+	c.BeginFetch(testBlob)
+	done := make(chan struct{})
+	go func() {
+		c.Get(context.Background(), testBlob)
+		close(done)
+	}()
+	for atomic.LoadInt64(&c.stats.Waiting) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	c.CompleteFetch(testBlob, blobInfo{})
+	<-done
+
+	stats := c.stats.snapshot()
+	if stats.Waiting != 0 || stats.WaitTime.count != 1 || stats.WaitTime.cumulative()[300] != 1 {
+		t.Fatalf("unexpected wait stats %+v", stats)
+	}
+	families, err := NewMetricsRegistry(c).Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, family := range families {
+		if family.GetName() == "cache_wait_duration_seconds" {
+			found = family.GetMetric()[0].GetHistogram().GetSampleCount() == 1
+		}
+	}
+	if !found {
+		t.Fatal("cache_wait_duration_seconds not exported")
+	}
+}
+
+func TestShardDirsOnDemand(t *testing.T) {
+	c, err := NewCache(Config{Dir: t.TempDir(), NamespaceByHost: true, DirMode: 0777})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fname := c.blobPath(c.blobKey("registry.test", testBlob))
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			errs <- c.mkdirFor(fname)
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Both the host and the shard directories, whatever the umask
+	for _, dir := range []string{filepath.Dir(fname), filepath.Dir(filepath.Dir(fname))} {
+		if fi, err := os.Stat(dir); err != nil || fi.Mode().Perm() != 0777 {
+			t.Fatalf("%s not created with the directory mode: %v %v", dir, fi.Mode(), err)
+		}
+	}
+}
+
+func TestPinned(t *testing.T) {
+	blobs := []string{strings.Repeat("1", 64), strings.Repeat("2", 64), strings.Repeat("3", 64)}
+	c, err := NewCache(Config{Dir: t.TempDir(), MaxEntries: 1, Pinned: []string{"sha256:" + blobs[0]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := func(method, digest string) {
+		w := httptest.NewRecorder()
+		c.AdminHandler(true).ServeHTTP(w, httptest.NewRequest(method, "/_cache/pin/"+digest, nil))
+		if w.Code != 200 {
+			t.Fatalf("%s %s: %d %s", method, digest, w.Code, w.Body)
+		}
+	}
+	admin("POST", "sha256:"+blobs[1])
+	for _, shaname := range blobs {
+		c.BeginFetch(shaname)
+		c.CompleteFetch(shaname, blobInfo{size: 1, diskSize: 1})
+	}
+	c.expire(0)
+	if c.entries[blobs[0]] == nil || c.entries[blobs[1]] == nil || c.entries[blobs[2]] != nil {
+		t.Fatal("only the pinned blobs should survive the eviction and the expiry")
+	}
+	for _, b := range c.blobList() {
+		if !b.Pinned {
+			t.Fatalf("%s not listed as pinned", b.Digest)
+		}
+	}
+
+	admin("DELETE", "sha256:"+blobs[1])
+	c.expire(0)
+	if c.entries[blobs[1]] != nil {
+		t.Fatal("an unpinned blob should expire")
+	}
+	if _, err := NewCache(Config{Dir: t.TempDir(), Pinned: []string{"latest"}}); err == nil {
+		t.Fatal("an invalid pinned digest must be refused")
+	}
+}
+
+// A Clock moving only when the test advances it
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+type fakeTicker struct {
+	c      chan time.Time
+	period time.Duration
+	next   time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) NewTicker(d time.Duration) Ticker {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTicker{c: make(chan time.Time), period: d, next: f.now.Add(d)}
+	f.tickers = append(f.tickers, t)
+	return t
+}
+
+// Moves the time forward, the ticks due are delivered before it returns
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	f.now = f.now.Add(d)
+	now, tickers := f.now, f.tickers
+	f.mu.Unlock()
+	for _, t := range tickers {
+		for !t.next.After(now) {
+			t.c <- t.next
+			t.next = t.next.Add(t.period)
+		}
+	}
+}
+
+func (f *fakeClock) tickerCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.tickers)
+}
+
+func (t *fakeTicker) Chan() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {}
+
+func TestExpireEveryWithClock(t *testing.T) {
+	clock := newFakeClock()
+	c, err := NewCache(Config{Dir: t.TempDir(), Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, recent := strings.Repeat("1", 64), strings.Repeat("2", 64)
+	c.BeginFetch(old)
+	c.CompleteFetch(old, blobInfo{size: 1, diskSize: 1})
+	clock.Advance(30 * time.Minute)
+	c.BeginFetch(recent)
+	c.CompleteFetch(recent, blobInfo{size: 1, diskSize: 1})
+
+	go c.ExpireEvery(time.Hour)
+	for clock.tickerCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The tick of the second hour is delivered once the first expiry is done
+	clock.Advance(2 * time.Hour)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.entries[old] != nil || c.entries[recent] != nil {
+		t.Fatal("blobs not accessed for an hour should expire")
+	}
+}
+
+func TestNegativeTTLWithClock(t *testing.T) {
+	clock := newFakeClock()
+	c, err := NewCache(Config{Dir: t.TempDir(), NegativeTTL: time.Minute, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.addNegative("registry.test/v2/library/test/blobs/sha256:" + testBlob)
+	clock.Advance(59 * time.Second)
+	if !c.isNegative("registry.test/v2/library/test/blobs/sha256:" + testBlob) {
+		t.Fatal("a 404 younger than NegativeTTL should be served")
+	}
+	clock.Advance(2 * time.Second)
+	if c.isNegative("registry.test/v2/library/test/blobs/sha256:" + testBlob) {
+		t.Fatal("a 404 older than NegativeTTL should be forgotten")
+	}
+}
+
+func TestFailureCooldownWithClock(t *testing.T) {
+	clock := newFakeClock()
+	c, err := NewCache(Config{Dir: t.TempDir(), FailureCooldown: 10 * time.Second, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.BeginFetch(testBlob)
+	c.FailFetch(testBlob)
+	clock.Advance(9 * time.Second)
+	if !c.coolingDown(testBlob) || c.BeginFetch(testBlob) {
+		t.Fatal("a FAILED blob should not be fetched during the cooldown")
+	}
+	clock.Advance(time.Second)
+	if c.coolingDown(testBlob) || !c.BeginFetch(testBlob) {
+		t.Fatal("a FAILED blob should be fetched again after the cooldown")
+	}
+}
+
+func TestMatchBlob(t *testing.T) {
+	c := newTestCache(t)
+	sha := testBlob
+	for _, tc := range []struct{ path, shaname string }{
+		// Docker Hub
+		{"/v2/library/ubuntu/blobs/sha256:" + sha, sha},
+		{"/v2/grafana/grafana/blobs/sha256:" + sha, sha},
+		{"/registry-v2/docker/registry/v2/blobs/sha256/" + sha[:2] + "/" + sha + "/data", sha},
+		// GCR and Artifact Registry
+		{"/v2/my-project/app/blobs/sha256:" + sha, sha},
+		{"/v2/my-project/repo/team/app/blobs/sha256:" + sha, sha},
+		{"/artifacts.my-project.appspot.com/containers/images/sha256:" + sha, sha},
+		{"/eu.artifacts.my-project.appspot.com/containers/images/sha256:" + sha, sha},
+		// ECR, the S3 redirect does not tell the digest
+		{"/v2/team/app/blobs/sha256:" + sha, sha},
+		{"/3f3fa8c1-0a5e-4b4e-9b2a-0d1e2f3a4b5c/7b1b4a3e-5e3f-4a2b-9c1d-2e3f4a5b6c7d", ""},
+		// ghcr.io
+		{"/v2/owner/image/blobs/sha256:" + sha, sha},
+		{"/ghcr1/blobs/sha256:" + sha, sha},
+		// Not blobs
+		{"/v2/library/ubuntu/manifests/latest", ""},
+		{"/v2/library/ubuntu/manifests/sha256:" + sha, ""},
+		{"/v2/library/ubuntu/blobs/uploads/", ""},
+		{"/v2/library/ubuntu/blobs/sha256:" + sha[:63], ""},
+		{"/v2/library/ubuntu/blobs/sha256:" + strings.ToUpper(sha), ""},
+		{"/v2/library/ubuntu/blobs/sha512:" + sha + sha, ""},
+		{"/v2/library/ubuntu/blobs/sha256:" + sha + "/extra", ""},
+		{"/v2/blobs/sha256:" + sha, ""},
+	} {
+		shaname, err := c.matchBlob(tc.path)
+		if err != nil || shaname != tc.shaname {
+			t.Errorf("matchBlob(%q) = %q, %v, want %q", tc.path, shaname, err, tc.shaname)
+		}
+	}
+}
+
+func TestBlobRegexps(t *testing.T) {
+	c, err := NewCache(Config{Dir: t.TempDir(), BlobRegexps: []string{
+		"^/layers/(?P<shaname>[a-f0-9]{64})$",
+		"^/any/(?P<shaname>[^/]+)$",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shaname, err := c.matchBlob("/layers/" + testBlob); err != nil || shaname != testBlob {
+		t.Fatalf("custom pattern: %q, %v", shaname, err)
+	}
+	// The defaults still match
+	if shaname, _ := c.matchBlob("/v2/a/blobs/sha256:" + testBlob); shaname != testBlob {
+		t.Fatalf("default pattern: %q", shaname)
+	}
+	// A capture that is not a digest never becomes a file name
+	if shaname, err := c.matchBlob("/any/..%2f..%2fetc"); err == nil || shaname != "" {
+		t.Fatalf("invalid capture: %q, %v", shaname, err)
+	}
+
+	for _, expr := range []string{"^/layers/(?P<shaname>[a-f0-9]{64}$", "^/layers/([a-f0-9]{64})$"} {
+		if _, err := NewCache(Config{Dir: t.TempDir(), BlobRegexps: []string{expr}}); err == nil || !strings.Contains(err.Error(), expr) {
+			t.Errorf("NewCache with %q: %v", expr, err)
+		}
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	f := newBloomFilter(1000)
+	key := func(i int) string {
+		sum := sha256.Sum256([]byte(strconv.Itoa(i)))
+		if i%2 == 0 {
+			return "registry.example.com/" + hex.EncodeToString(sum[:])
+		}
+		return hex.EncodeToString(sum[:])
+	}
+	for i := 0; i < 1000; i++ {
+		f.add(key(i))
+	}
+	for i := 0; i < 1000; i++ {
+		if !f.mayContain(key(i)) {
+			t.Fatalf("%s added but not found", key(i))
+		}
+	}
+	positives := 0
+	for i := 1000; i < 11000; i++ {
+		if f.mayContain(key(i)) {
+			positives++
+		}
+	}
+	if positives > 100 {
+		t.Fatalf("%d false positives out of 10000", positives)
+	}
+}
+
+func TestLocalStoreList(t *testing.T) {
+	s := localStore{dir: t.TempDir() + "/", dirMode: 0755, fileMode: 0644}
+	keys := []string{testBlob, "registry.example.com/" + testBlob}
+	for _, key := range keys {
+		if err := s.Put(key, strings.NewReader("blob"), 4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Neither partial uploads nor misplaced files
+	ioutil.WriteFile(tempPath(shardPath(s.dir, testBlob)), nil, 0644)
+	ioutil.WriteFile(s.dir+testBlob, nil, 0644)
+
+	var listed []string
+	if err := s.List(func(shaname string) { listed = append(listed, shaname) }); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(listed)
+	if !reflect.DeepEqual(listed, keys) {
+		t.Fatalf("listed %q, want %q", listed, keys)
+	}
+}
+
+type hostRecorder []string
+
+func (r *hostRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	*r = append(*r, req.URL.Host)
+	return &http.Response{StatusCode: 200, Body: http.NoBody, Request: req}, nil
+}
+
+func TestReload(t *testing.T) {
+	hosts := &hostRecorder{}
+	c, err := NewCache(Config{Dir: t.TempDir(), Upstream: hosts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, shaname := range []string{strings.Repeat("1", 64), strings.Repeat("2", 64), strings.Repeat("3", 64)} {
+		c.BeginFetch(shaname)
+		c.CompleteFetch(shaname, blobInfo{size: 1, diskSize: 1})
+	}
+
+	c.Reload(Reloadable{MaxEntries: 1, ServeRateLimit: 1 << 20, MirrorMap: map[string]string{"registry.test": "mirror.test"}})
+	if c.available != 1 {
+		t.Fatalf("%d entries left over the new limit", c.available)
+	}
+	if c.serveLimiter == nil || c.serveLimiter.rate != 1<<20 {
+		t.Fatal("rate limit not reloaded")
+	}
+	req, _ := http.NewRequest("GET", "https://registry.test/v2/", nil)
+	c.cfg.Upstream.RoundTrip(req)
+
+	c.Reload(Reloadable{})
+	if c.serveLimiter != nil {
+		t.Fatal("rate limit not removed")
+	}
+	c.cfg.Upstream.RoundTrip(req)
+	if !reflect.DeepEqual([]string(*hosts), []string{"mirror.test", "registry.test"}) {
+		t.Fatalf("upstream requests for %v", *hosts)
+	}
+}
+
+func TestManifestBound(t *testing.T) {
+	c := newTestCache(t)
+	c.cfg.ManifestTTL = time.Minute
+	now := time.Now()
+	c.storeManifest("expired tag", &manifestEntry{fetched: now.Add(-time.Hour)})
+	for i := 0; i < maxManifests; i++ {
+		c.storeManifest(strconv.Itoa(i), &manifestEntry{fetched: now, pinned: true})
+	}
+	if len(c.manifests) != maxManifests {
+		t.Fatalf("%d manifests in memory", len(c.manifests))
+	}
+	if c.manifests["expired tag"] != nil {
+		t.Fatal("the expired tag should be dropped first")
+	}
+	c.storeManifest("new", &manifestEntry{fetched: now})
+	if len(c.manifests) != maxManifests || c.manifests["new"] == nil {
+		t.Fatalf("%d manifests in memory", len(c.manifests))
+	}
+}
+
+func TestRemoveInProgress(t *testing.T) {
+	c := newTestCache(t)
+	other := strings.Repeat("1", 64)
+	for _, shaname := range []string{testBlob, other} {
+		c.BeginFetch(shaname)
+		os.MkdirAll(filepath.Dir(c.lockPath(shaname)), 0755)
+	}
+	if locked, err := c.createLock(testBlob); !locked || err != nil {
+		t.Fatalf("lock not created: %v", err)
+	}
+	// other waits for the download of another process
+	if err := ioutil.WriteFile(c.lockPath(other), []byte("1 otherhost 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c.removeInProgress()
+	if _, err := os.Stat(c.lockPath(testBlob)); !os.IsNotExist(err) {
+		t.Fatalf("lock of the interrupted download left: %v", err)
+	}
+	if !c.lockFresh(other) {
+		t.Fatal("lock of another process removed")
+	}
+}
+
+func TestForgetBroken(t *testing.T) {
+	c := newTestCache(t)
+	info := blobInfo{size: 5, diskSize: 5}
+	c.BeginFetch(testBlob)
+	os.MkdirAll(filepath.Dir(c.blobPath(testBlob)), 0755)
+	if err := ioutil.WriteFile(c.blobPath(testBlob), []byte("12345"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.CompleteFetch(testBlob, info)
+
+	if gone, _ := c.forgetBroken(testBlob, info); gone {
+		t.Fatal("a fine file was forgotten")
+	}
+	// Evicted: gone, but not broken
+	c.mu.Lock()
+	c.removeEntry(testBlob)
+	c.mu.Unlock()
+	if gone, broken := c.forgetBroken(testBlob, info); !gone || broken {
+		t.Fatalf("evicted blob: gone %v, broken %v", gone, broken)
+	}
+
+	c.BeginFetch(testBlob)
+	ioutil.WriteFile(c.blobPath(testBlob), []byte("12345"), 0644)
+	c.CompleteFetch(testBlob, info)
+	os.Truncate(c.blobPath(testBlob), 2)
+	if gone, broken := c.forgetBroken(testBlob, info); !gone || !broken {
+		t.Fatalf("truncated blob: gone %v, broken %v", gone, broken)
+	}
+	if _, ok, _ := c.Get(context.Background(), testBlob); ok {
+		t.Fatal("truncated blob still available")
+	}
+}
+
+func TestReadBounded(t *testing.T) {
+	for _, size := range []int{10, 11} {
+		content := strings.Repeat("x", size)
+		data, rc, err := readBounded(ioutil.NopCloser(strings.NewReader(content)), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (size <= 10) != (string(data) == content) || (size > 10 && data != nil) {
+			t.Fatalf("%d bytes read of %d", len(data), size)
+		}
+		if sent, _ := ioutil.ReadAll(rc); string(sent) != content {
+			t.Fatalf("%d bytes sent of %d", len(sent), size)
+		}
+	}
+}
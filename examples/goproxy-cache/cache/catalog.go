@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// The API version check, GET /v2/, is always forwarded: its 401 tells the
+// client where to get a token, and its answer depends on the credentials.
+//
+// With Config.CatalogTTL the GET /v2/_catalog answers are kept for a short
+// while. The catalog lists what the credentials may see, so the entries are
+// keyed by the Authorization header, along with the pagination query.
+
+const (
+	apiVersionPath = "/v2/"
+	catalogPath    = "/v2/_catalog"
+	// Bound of the catalog entries, the expired ones are dropped first
+	maxCatalogs = 256
+)
+
+type catalogEntry struct {
+	body    []byte
+	header  http.Header
+	expires time.Time
+}
+
+func catalogKey(req *http.Request) string {
+	return req.URL.Host + "?" + req.URL.RawQuery + " " + authHash(req)
+}
+
+// Returns the cached catalog of req, or nil
+func (c *Cache) catalogReqHandler(req *http.Request, ctx *goproxy.ProxyCtx) *http.Response {
+	c.cm.Lock()
+	entry := c.catalogs[catalogKey(req)]
+	c.cm.Unlock()
+	if entry == nil || c.cfg.Clock.Now().After(entry.expires) {
+		ctx.Logf("Catalog of %s not in cache", req.URL.Host)
+		return nil
+	}
+	ctx.Logf("Catalog of %s in cache: return it !", req.URL.Host)
+	return &http.Response{
+		Request:       req,
+		StatusCode:    http.StatusOK,
+		Header:        entry.header.Clone(),
+		ContentLength: int64(len(entry.body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(entry.body)),
+	}
+}
+
+func (c *Cache) catalogRespHandler(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp.ContentLength > maxManifestSize {
+		return resp
+	}
+	body, rest, err := readBounded(resp.Body, maxManifestSize)
+	resp.Body = rest
+	if err != nil {
+		ctx.Warnf("Cannot read the catalog of %s: %s", resp.Request.URL.Host, err)
+		return resp
+	}
+	if body == nil {
+		ctx.Logf("Catalog of %s too big to be cached", resp.Request.URL.Host)
+		return resp
+	}
+
+	entry := &catalogEntry{body: body, header: make(http.Header), expires: c.cfg.Clock.Now().Add(c.cfg.CatalogTTL)}
+	// Link paginates the catalog
+	for _, k := range []string{"Content-Type", "Link", "Docker-Distribution-Api-Version"} {
+		if v := resp.Header.Get(k); v != "" {
+			entry.header.Set(k, v)
+		}
+	}
+	ctx.Logf("Store the catalog of %s in cache", resp.Request.URL.Host)
+	now := c.cfg.Clock.Now()
+	c.cm.Lock()
+	defer c.cm.Unlock()
+	if len(c.catalogs) >= maxCatalogs {
+		for key, old := range c.catalogs {
+			if now.After(old.expires) {
+				delete(c.catalogs, key)
+			}
+		}
+		for key := range c.catalogs {
+			if len(c.catalogs) < maxCatalogs {
+				break
+			}
+			delete(c.catalogs, key)
+		}
+	}
+	c.catalogs[catalogKey(resp.Request)] = entry
+	return resp
+}
@@ -0,0 +1,36 @@
+package cache
+
+import "time"
+
+// The TTLs, the cooldowns and the LRU of the cache read the time of its
+// Config.Clock, so that the tests can move it forward. The durations measured
+// for the logs and the statistics, the rate limits and the lock files use the
+// real time.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// A time.Ticker of a Clock
+type Ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) Chan() <-chan time.Time {
+	return t.C
+}
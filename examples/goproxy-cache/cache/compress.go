@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var errSizeMismatch = errors.New("file size does not match the cache entry")
+
+// With Config.Compress the blobs are stored gzipped. Most layers are already
+// gzipped by the registry, so the first chunk of a blob is used to guess
+// whether compressing it is worth it; if not, the blob is stored as-is.
+
+// Blobs whose first chunk does not shrink by 10% are stored uncompressed
+func compressible(p []byte) bool {
+	var buf bytes.Buffer
+	gz, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	gz.Write(p)
+	gz.Close()
+	return buf.Len() < len(p)*9/10
+}
+
+// Closes both the decompressor and the file
+type gzipReadCloser struct {
+	*gzip.Reader
+	f io.Closer
+}
+
+func (r gzipReadCloser) Close() error {
+	r.Reader.Close()
+	return r.f.Close()
+}
+
+// Moves to offset in a blob opened by openBlob: a compressed one cannot seek
+func skip(r io.Reader, offset int64) error {
+	if s, ok := r.(io.Seeker); ok {
+		_, err := s.Seek(offset, io.SeekStart)
+		return err
+	}
+	_, err := io.CopyN(ioutil.Discard, r, offset)
+	return err
+}
+
+// Opens an AVAILABLE blob and returns its original content and size. The
+// size of a blob stored as-is comes from the open file, not from another stat.
+// A file whose size is not info.diskSize, if known, was truncated or replaced
+// behind our back: errSizeMismatch is returned. An inline blob is read from the
+// database.
+func (c *Cache) openBlob(shaname string, info blobInfo) (io.ReadCloser, int64, error) {
+	f, size, err := c.openStored(shaname, info)
+	if err != nil || !info.compressed {
+		return f, size, err
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return gzipReadCloser{gz, f}, info.size, nil
+}
+
+// Same as openBlob but a compressed blob is returned gzipped, as it is stored
+func (c *Cache) openStored(shaname string, info blobInfo) (readSeekCloser, int64, error) {
+	var f readSeekCloser
+	var size int64
+	if info.inline {
+		data, err := c.readInline(shaname)
+		if err != nil {
+			return nil, 0, err
+		}
+		f, size = nopSeekCloser{bytes.NewReader(data)}, int64(len(data))
+	} else {
+		file, err := os.Open(c.filePath(shaname, info))
+		if err != nil {
+			return nil, 0, err
+		}
+		fi, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, 0, err
+		}
+		f, size = file, fi.Size()
+	}
+	if info.diskSize > 0 && size != info.diskSize {
+		f.Close()
+		return nil, 0, errSizeMismatch
+	}
+	return f, size, nil
+}
+
+// A compressed blob is sent as stored, with Content-Encoding: gzip, to the
+// clients accepting it: it is not decompressed for nothing. A Range is a range
+// of the original content, it is served decompressed.
+func acceptsGzip(req *http.Request) bool {
+	if req.Header.Get("Range") != "" {
+		return false
+	}
+	for _, coding := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(coding, ";")
+		if strings.TrimSpace(params[0]) != "gzip" {
+			continue
+		}
+		for _, param := range params[1:] {
+			if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") && strings.Trim(q[2:], "0.") == "" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
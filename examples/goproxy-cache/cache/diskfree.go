@@ -0,0 +1,14 @@
+//go:build !windows
+
+package cache
+
+import "syscall"
+
+// Returns the bytes available to the process on the filesystem of dir
+func diskFree(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
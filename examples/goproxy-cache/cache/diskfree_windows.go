@@ -0,0 +1,7 @@
+package cache
+
+import "errors"
+
+func diskFree(dir string) (int64, error) {
+	return 0, errors.New("free disk space unknown on windows")
+}
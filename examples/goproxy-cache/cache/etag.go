@@ -0,0 +1,28 @@
+package cache
+
+import (
+	"net/http"
+	"strings"
+)
+
+// The ETag of a blob is its quoted digest, like the registries send it
+
+func blobETag(contentDigest string) string {
+	return `"` + contentDigest + `"`
+}
+
+// Returns true if the If-None-Match header of req lists etag. The digests
+// are compared weakly and may come unquoted from some clients.
+func etagMatch(req *http.Request, etag string) bool {
+	header := req.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag || `"`+tag+`"` == etag {
+			return true
+		}
+	}
+	return false
+}
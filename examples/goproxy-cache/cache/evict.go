@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A byte size flag accepting suffixes like 512MB or 20GB
+type SizeValue int64
+
+func (v *SizeValue) String() string {
+	return strconv.FormatInt(int64(*v), 10)
+}
+
+func (v *SizeValue) Set(s string) error {
+	size, err := parseSize(s)
+	if err != nil {
+		return err
+	}
+	*v = SizeValue(size)
+	return nil
+}
+
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mult   int64
+	}{
+		{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+	}
+
+	str := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(str, unit.suffix) {
+			str = strings.TrimSuffix(str, unit.suffix)
+			mult = unit.mult
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(str), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// Marks an entry AVAILABLE and accounts for its disk size. c.mu must be held.
+func (c *Cache) markAvailable(shaname string, info blobInfo) {
+	entry := c.getEntry(shaname)
+	entry.blobInfo = info
+	entry.atime = c.cfg.Clock.Now()
+	if entry.stored.IsZero() {
+		entry.stored = entry.atime
+	}
+	if info.readDir == "" {
+		c.totalSize += info.diskSize
+		c.available++
+	}
+	c.setStatus(shaname, AVAILABLE)
+}
+
+// Called with the digest, prefixed by "<host>/" with Config.NamespaceByHost,
+// and the size of a blob removed from the cache
+type EvictFunc func(digest string, size int64)
+
+// Removes an AVAILABLE entry from the disk and from the map, whether it is
+// evicted, expired or purged. Config.OnEvict is called with c.mu held, it
+// must not block nor use the Cache. c.mu must be held.
+func (c *Cache) removeEntry(shaname string) {
+	entry := c.entries[shaname]
+	if entry == nil || entry.status != AVAILABLE {
+		return
+	}
+	// The files of the read-only directories are left alone
+	if entry.readDir == "" {
+		if entry.inline {
+			if err := c.deleteInline(shaname); err != nil {
+				fmt.Printf("Cannot remove %s from %s: %s\n", shaname, inlineDBName, err)
+			}
+		} else if err := c.local.Delete(shaname); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Cannot remove %s: %s\n", c.blobPath(shaname), err)
+		}
+		c.totalSize -= entry.diskSize
+		c.available--
+	}
+	delete(c.entries, shaname)
+	if c.cfg.OnEvict != nil {
+		host, digest := splitKey(shaname)
+		digest = "sha256:" + digest
+		if host != "" {
+			digest = host + "/" + digest
+		}
+		c.cfg.OnEvict(digest, entry.size)
+	}
+}
+
+// Eviction policies: EvictLRU evicts the least recently used blobs first,
+// EvictLFU the least hit ones so that the base layers pulled by many images
+// survive the one-off layers, the least recently used first among equals
+const (
+	EvictLRU = "lru"
+	EvictLFU = "lfu"
+)
+
+// Counts a hit of an AVAILABLE blob
+func (c *Cache) countHit(shaname string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if entry := c.entries[shaname]; entry != nil {
+		atomic.AddInt64(&entry.hits, 1)
+	}
+}
+
+// Keeps an AVAILABLE entry from being evicted or expired while its blob is
+// read, until release. Returns nil if the entry is not AVAILABLE anymore.
+func (c *Cache) acquire(shaname string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.entries[shaname]
+	if entry == nil || entry.status != AVAILABLE {
+		return nil
+	}
+	entry.readers++
+	return entry
+}
+
+func (c *Cache) release(entry *cacheEntry) {
+	c.mu.Lock()
+	entry.readers--
+	c.mu.Unlock()
+}
+
+// Evicts entries according to the policy until the cache fits in MaxSize
+// and MaxEntries. Entries IN_PROGRESS, pinned or being read are never
+// evicted, keep goes last: a blob just downloaded has no hits yet. c.mu must
+// be held.
+func (c *Cache) evict(keep string) {
+	if !c.overLimits() {
+		return
+	}
+
+	var candidates []string
+	for shaname, entry := range c.entries {
+		if entry.status == AVAILABLE && entry.readers == 0 && entry.readDir == "" && !c.isPinned(shaname) {
+			candidates = append(candidates, shaname)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i] == keep || candidates[j] == keep {
+			return candidates[i] != keep
+		}
+		a, b := c.entries[candidates[i]], c.entries[candidates[j]]
+		if c.cfg.EvictPolicy == EvictLFU && a.hits != b.hits {
+			return a.hits < b.hits
+		}
+		return a.atime.Before(b.atime)
+	})
+
+	for _, shaname := range candidates {
+		if !c.overLimits() {
+			break
+		}
+		fmt.Printf("evict: %s (%d bytes)\n", shaname, c.entries[shaname].size)
+		c.removeEntry(shaname)
+	}
+}
+
+// c.mu must be held.
+func (c *Cache) overLimits() bool {
+	return c.cfg.MaxSize > 0 && c.totalSize > c.cfg.MaxSize ||
+		c.cfg.MaxEntries > 0 && c.available > c.cfg.MaxEntries
+}
+
+// Removes the entries not accessed since ttl. Like evict, it skips the
+// entries IN_PROGRESS since removeEntry only deals with AVAILABLE ones, the
+// pinned ones and those being read.
+func (c *Cache) expire(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	deadline := c.cfg.Clock.Now().Add(-ttl)
+	for shaname, entry := range c.entries {
+		if entry.status == AVAILABLE && entry.readers == 0 && entry.atime.Before(deadline) && !c.isPinned(shaname) {
+			fmt.Printf("expire: %s (last access %s)\n", shaname, entry.atime.Format(time.RFC3339))
+			c.removeEntry(shaname)
+		}
+	}
+}
+
+func (c *Cache) ExpireEvery(ttl time.Duration) {
+	period := time.Hour
+	if ttl < period {
+		period = ttl
+	}
+	ticker := c.cfg.Clock.NewTicker(period)
+	defer ticker.Stop()
+	for range ticker.Chan() {
+		c.expire(ttl)
+	}
+}
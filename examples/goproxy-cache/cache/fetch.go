@@ -0,0 +1,152 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Sends the upstream requests, and the CONNECT tunnels which are not
+// intercepted, through a parent proxy. Without it HTTP_PROXY and HTTPS_PROXY
+// are used, like goproxy does by default.
+func SetParentProxy(proxy *goproxy.ProxyHttpServer, parent string) error {
+	u, err := url.Parse(parent)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid parent proxy %q", parent)
+	}
+	proxy.Tr.Proxy = http.ProxyURL(u)
+	proxy.ConnectDial = proxy.NewConnectDialToProxy(parent)
+	return nil
+}
+
+// Returns false if done is closed before a slot is available
+func (c *Cache) acquireFetchSlot(done <-chan struct{}) bool {
+	if c.fetchSlots == nil {
+		return true
+	}
+	select {
+	case c.fetchSlots <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (c *Cache) releaseFetchSlot() {
+	if c.fetchSlots != nil {
+		<-c.fetchSlots
+	}
+}
+
+// Delay before the first retry of a blob fetch, doubled for each following one
+var fetchRetryBackoff = 500 * time.Millisecond
+
+// The registry or its CDN is temporarily unavailable
+func transientStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// RoundTripper of the blob downloaders: the response handlers are not called
+// when the upstream cannot be reached, so the download is aborted here.
+// Blob GETs are idempotent, they are retried Config.FetchRetries times on
+// errors and transient statuses. Only the last response reaches the response
+// handlers, so no cacheTeeReader ever sees a failed attempt. The redirects
+// are followed, see redirect.go.
+//
+// When the upstream cannot be reached the client gets a 502 explaining it,
+// rather than the plain text error of goproxy.
+//
+// Config.FetchTimeout bounds the whole fetch: a body still read at the deadline
+// fails, and the cacheTeeReader marks the entry FAILED, see FailFetch.
+func (c *Cache) fetchRoundTrip(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+	spanCtx, span := c.cfg.Tracer.Start(req.Context(), "upstream-fetch", trace.WithSpanKind(trace.SpanKindClient))
+	req = req.WithContext(spanCtx)
+	cancel := context.CancelFunc(func() {})
+	if c.cfg.FetchTimeout > 0 {
+		var reqCtx context.Context
+		reqCtx, cancel = context.WithTimeout(req.Context(), c.cfg.FetchTimeout)
+		req = req.WithContext(reqCtx)
+	}
+
+	backoff := fetchRetryBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := c.upstreamRoundTrip(req, ctx)
+		retry := err != nil || transientStatus(resp.StatusCode)
+		if !retry || attempt >= c.cfg.FetchRetries || req.Method != "GET" {
+			if err != nil {
+				ctx.Warnf("Cannot fetch %s: %s", req.URL, err)
+				shaname := stateOf(ctx).fetching
+				if req.Context().Err() == context.Canceled {
+					c.abortFetch(ctx)
+				} else {
+					c.failFetch(ctx)
+				}
+				cancel()
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				span.End()
+				if shaname == "" || req.Context().Err() != nil {
+					return resp, err
+				}
+				return upstreamUnreachable(req, shaname, err), nil
+			}
+			span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode), attribute.Int("attempts", attempt+1))
+			if resp.StatusCode >= 400 {
+				span.SetStatus(codes.Error, resp.Status)
+			}
+			resp.Body = endSpanOnClose(&cancelOnClose{resp.Body, cancel}, span)
+			return resp, nil
+		}
+
+		if err != nil {
+			ctx.Warnf("Cannot fetch %s: %s, retry in %s", req.URL, err, backoff)
+		} else {
+			ctx.Warnf("Fetch of %s returned %s, retry in %s", req.URL, resp.Status, backoff)
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			c.abortFetch(ctx)
+			cancel()
+			span.SetStatus(codes.Error, req.Context().Err().Error())
+			span.End()
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+	}
+}
+
+func upstreamUnreachable(req *http.Request, shaname string, err error) *http.Response {
+	body, _ := json.Marshal(map[string]string{
+		"error":    "the cache could not reach the upstream registry and does not have this blob",
+		"digest":   "sha256:" + digestOf(shaname),
+		"upstream": req.URL.Host,
+		"detail":   err.Error(),
+	})
+	return goproxy.NewResponse(req, "application/json", http.StatusBadGateway, string(body))
+}
+
+// Releases the deadline of a fetch once its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
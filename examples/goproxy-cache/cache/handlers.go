@@ -0,0 +1,586 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/elazarl/goproxy"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Per request data kept in ctx.UserData between CacheReqHandler and CacheRespHandler
+type reqState struct {
+	fetching string     // blob this request is downloading for the cache
+	hit      bool       // response served from the cache
+	miss     bool       // cacheable response fetched from the upstream
+	handled  bool       // upstream response already processed by CacheReqHandler, or passed through
+	upload   string     // file capturing the blob pushed by this request, see push.go
+	span     trace.Span // of the request, see trace.go
+}
+
+func stateOf(ctx *goproxy.ProxyCtx) *reqState {
+	st, ok := ctx.UserData.(*reqState)
+	if !ok {
+		st = &reqState{}
+		ctx.UserData = st
+	}
+	return st
+}
+
+// The request handler to register with proxy.OnRequest().Do
+func (c *Cache) ReqHandler() goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(c.CacheReqHandler)
+}
+
+// The response handler to register with proxy.OnResponse().Do
+func (c *Cache) RespHandler() goproxy.RespHandler {
+	return goproxy.FuncRespHandler(c.CacheRespHandler)
+}
+
+// Creates a cache and registers its handlers on proxy for the requests matching
+// conds, all of them if none. The upstream is reached with proxy.Tr unless
+// cfg.Upstream is set. Intercepting the CONNECTs to the registries is left to
+// the caller, with the MITM rules of its choice.
+func RegisterCache(proxy *goproxy.ProxyHttpServer, cfg Config, conds ...goproxy.ReqCondition) (*Cache, error) {
+	if cfg.Upstream == nil {
+		cfg.Upstream = proxy.Tr
+	}
+	c, err := NewCache(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.proxy = proxy
+	respConds := make([]goproxy.RespCondition, len(conds))
+	for i, cond := range conds {
+		respConds[i] = cond
+	}
+	proxy.OnRequest(conds...).Do(c.ReqHandler())
+	proxy.OnResponse(respConds...).Do(c.RespHandler())
+	return c, nil
+}
+
+// Returns the upstream host and the name of the layer, or an empty name
+func (c *Cache) shouldBeCached(u *url.URL, ctx *goproxy.ProxyCtx) (host string, shaname string) {
+	ctx.Logf("shouldBeCached: %s", u.Path)
+	shaname, err := c.matchBlob(u.Path)
+	if err != nil {
+		ctx.Warnf("%v", err)
+		return "", ""
+	}
+	if shaname == "" {
+		ctx.Logf("....no....")
+		return "", ""
+	}
+	ctx.Logf("....yes....: %s", shaname)
+	return u.Host, shaname
+}
+
+// Returns the digest captured by the first blob pattern matching the path,
+// an empty name if none matches
+func (c *Cache) matchBlob(path string) (string, error) {
+	for _, re := range c.blobRes {
+		if res := re.FindStringSubmatch(path); res != nil {
+			shaname := res[re.SubexpIndex("shaname")]
+			// Custom patterns could capture anything, the name ends up in a path
+			if !blobNameRe.MatchString(shaname) {
+				return "", fmt.Errorf("Invalid digest %q in %s", shaname, path)
+			}
+			return shaname, nil
+		}
+	}
+	return "", nil
+}
+
+// Builds the response of a cache hit, returns nil if the file cannot be served
+// or if the entry was removed since it was looked up. The entry is not evicted
+// until the body is closed.
+func (c *Cache) serveBlob(shaname string, info blobInfo, req *http.Request, ctx *goproxy.ProxyCtx) *http.Response {
+	entry := c.acquire(shaname)
+	if entry == nil {
+		ctx.Logf("%s was removed from the cache meanwhile", shaname)
+		return nil
+	}
+	// The Content-Length is the original size of a compressed blob, unless it
+	// is sent gzipped
+	gzipped := info.compressed && acceptsGzip(req)
+	var f io.ReadCloser
+	var size int64
+	var err error
+	if gzipped {
+		f, size, err = c.openStored(shaname, info)
+	} else {
+		f, size, err = c.openBlob(shaname, info)
+	}
+	if err != nil {
+		c.release(entry)
+		ctx.Warnf("Cannot open and read file %s: %s", c.filePath(shaname, info), err)
+		return nil
+	}
+
+	resp := &http.Response{}
+	resp.Request = req
+	resp.TransferEncoding = req.TransferEncoding
+	resp.Header = make(http.Header)
+	// Legacy cache files have no metadata
+	contentType := info.contentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	resp.Header.Add("Content-Type", contentType)
+	// The digest of a blob is its name, the clients check it
+	contentDigest := info.contentDigest
+	if contentDigest == "" {
+		contentDigest = "sha256:" + digestOf(shaname)
+	}
+	resp.Header.Add("Docker-Content-Digest", contentDigest)
+	resp.Header.Add("Etag", blobETag(contentDigest))
+	resp.Header.Add("Accept-Ranges", "bytes")
+	if info.compressed {
+		resp.Header.Set("Vary", "Accept-Encoding")
+	}
+	if gzipped {
+		resp.Header.Set("Content-Encoding", "gzip")
+	}
+	if age := ageSince(c.cfg.Clock.Now(), info.stored); age != "" {
+		resp.Header.Set("Age", age)
+	}
+	resp.StatusCode = 200
+	resp.ContentLength = size
+	resp.Body = f
+
+	// A client revalidating a blob it already has gets no body
+	if (req.Method == "GET" || req.Method == "HEAD") && etagMatch(req, blobETag(contentDigest)) {
+		ctx.Logf("%s not modified", shaname)
+		f.Close()
+		c.release(entry)
+		resp.StatusCode = http.StatusNotModified
+		resp.Header.Del("Content-Type")
+		resp.ContentLength = 0
+		resp.Body = http.NoBody
+		atomic.AddInt64(&c.stats.Hits, 1)
+		logEvent(ctx, "not_modified", shaname, "HIT")
+		stateOf(ctx).hit = true
+		return resp
+	}
+
+	// Docker resumes interrupted downloads with a single byte range
+	start, length, partial, err := parseRange(req.Header.Get("Range"), size)
+	if err != nil {
+		ctx.Logf("Unsatisfiable range %s for %s", req.Header.Get("Range"), shaname)
+		f.Close()
+		c.release(entry)
+		resp.StatusCode = http.StatusRequestedRangeNotSatisfiable
+		resp.Header.Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+		resp.Header.Set("Content-Length", "0")
+		resp.ContentLength = 0
+		resp.Body = http.NoBody
+		return resp
+	}
+	if partial {
+		if err := skip(f, start); err != nil {
+			ctx.Warnf("Cannot seek in file %s", c.filePath(shaname, info))
+			f.Close()
+			c.release(entry)
+			return nil
+		}
+		ctx.Logf("Serve range %s of %s", contentRange(start, length, size), shaname)
+		resp.StatusCode = http.StatusPartialContent
+		resp.Header.Set("Content-Range", contentRange(start, length, size))
+		resp.ContentLength = length
+		resp.Body = sectionReadCloser{io.LimitReader(f, length), f}
+	}
+	// Lets net/http send the body without chunking, with sendfile(2)
+	resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	atomic.AddInt64(&c.stats.Hits, 1)
+	logEvent(ctx, "hit", shaname, "HIT", "bytes", resp.ContentLength)
+	c.rm.RLock()
+	limiter := c.serveLimiter
+	c.rm.RUnlock()
+	resp.Body = &hitBody{resp.Body, limiter, &c.stats.BytesServed, func() { c.release(entry) }}
+	stateOf(ctx).hit = true
+	return resp
+}
+
+func (c *Cache) CacheReqHandler(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	// The session prefixing the lines of this request is bound to its URL here
+	ctx.Logf("CacheReqHandler %s %s", req.Method, req.URL)
+	// The ctx may be shared by several requests on the same connection
+	ctx.UserData = &reqState{}
+	req = c.startRequestSpan(req, ctx)
+	c.mirrorReqHandler(req, ctx)
+	if c.cfg.NoCache {
+		ctx.Logf("Caching disabled, forward %s", req.URL)
+		return req, nil
+	}
+
+	if req.URL.Path == apiVersionPath {
+		ctx.Logf("API version check of %s, forward it", req.URL.Host)
+		return req, nil
+	}
+	if req.URL.Path == catalogPath && req.Method == "GET" && c.cfg.CatalogTTL > 0 {
+		if resp := c.catalogReqHandler(req, ctx); resp != nil {
+			atomic.AddInt64(&c.stats.Hits, 1)
+			logEvent(ctx, "catalog_hit", "", "HIT", "bytes", resp.ContentLength)
+			stateOf(ctx).hit = true
+			return req, resp
+		}
+		stateOf(ctx).miss = true
+		return req, nil
+	}
+
+	if key := manifestShouldBeCached(req.URL.Path); key != "" && req.Method == "GET" {
+		resp, hit := c.manifestReqHandler(key, req, ctx)
+		if hit {
+			atomic.AddInt64(&c.stats.Hits, 1)
+			logEvent(ctx, "manifest_hit", key, "HIT", "bytes", resp.ContentLength)
+			resp.Body = countingReadCloser{resp.Body, &c.stats.BytesServed}
+			stateOf(ctx).hit = true
+		} else {
+			atomic.AddInt64(&c.stats.Misses, 1)
+			logEvent(ctx, "manifest_miss", key, "MISS")
+			stateOf(ctx).miss = true
+			// A response from the revalidation is already stored
+			stateOf(ctx).handled = resp != nil
+		}
+		return req, resp
+	}
+
+	if digest := blobMount(req); digest != "" {
+		c.logBlobMount(digest, req, ctx)
+		return req, nil
+	}
+	if c.cfg.MirrorPushes {
+		if fname := c.uploadFile(req); fname != "" {
+			c.captureUpload(fname, req, ctx)
+			return req, nil
+		}
+	}
+
+	if host, digest := c.shouldBeCached(req.URL, ctx); digest != "" {
+		shaname := c.blobKey(host, digest)
+		if req.Method == "HEAD" {
+			return req, c.serveHead(shaname, req, ctx)
+		}
+		if req.Method != "GET" {
+			ctx.Logf("%s of %s, forward it", req.Method, shaname)
+			stateOf(ctx).handled = true
+			return req, nil
+		}
+		ctx.Logf("Check Cache for %s", shaname)
+		lookupCtx, lookup := c.cfg.Tracer.Start(req.Context(), "cache-lookup")
+		defer lookup.End()
+		for {
+			// Wait for other download: if it fails the entry goes back to EMPTY
+			// and the first waiter to get a fetch slot becomes the new downloader,
+			// or it is FAILED and the waiters are passed through until the
+			// cooldown is over
+			info, ok, waited := c.Get(req.Context(), shaname)
+			if waited > 0 {
+				ctx.Logf("Waited %s for the download of %s", waited, shaname)
+				logEvent(ctx, "wait", shaname, "WAIT", "duration", waited.String())
+				c.traceWait(lookupCtx, waited)
+			}
+			if ok && info.private && !hasCredentials(req) {
+				ctx.Logf("%s was fetched with credentials, forward the request", shaname)
+				return req, nil
+			}
+			if ok {
+				ctx.Logf("Cache Exists: return it !")
+				if resp := c.serveBlob(shaname, info, req, ctx); resp != nil {
+					c.countHit(shaname)
+					return req, resp
+				}
+				gone, broken := c.forgetBroken(shaname, info)
+				if !gone {
+					return req, nil
+				}
+				// Evicted since Get, or removed or truncated behind the back
+				// of the cache: the entry is gone, look it up again
+				if broken {
+					ctx.Warnf("%s is missing or truncated on disk, fetch it again", shaname)
+				}
+				continue
+			}
+			if c.isNegative(negativeKey(req)) {
+				ctx.Logf("%s is unknown to the upstream, return a 404", shaname)
+				logEvent(ctx, "negative_hit", shaname, "HIT")
+				stateOf(ctx).hit = true
+				return req, blobUnknown(req, shaname)
+			}
+			if c.coolingDown(shaname) {
+				// Do not hammer a broken upstream with downloads
+				ctx.Logf("The last download of %s failed, forward the request", shaname)
+				stateOf(ctx).handled = true
+				stateOf(ctx).miss = true
+				return req, nil
+			}
+			// Block until an upstream fetch slot frees up, the entry may have
+			// changed meanwhile
+			if req.Context().Err() != nil || !c.acquireFetchSlot(req.Context().Done()) {
+				ctx.Logf("Request cancelled while waiting for %s", shaname)
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusServiceUnavailable, "request cancelled")
+			}
+			if c.BeginFetch(shaname) {
+				break
+			}
+			c.releaseFetchSlot()
+		}
+
+		ctx.Logf("Not in cache")
+		// Another process sharing the directory may be downloading it, its
+		// download can be long: the fetch slot is given back meanwhile
+		if c.lockFresh(shaname) {
+			c.releaseFetchSlot()
+			if info, ok := c.waitForLock(req.Context(), shaname); ok {
+				ctx.Logf("%s downloaded by another process", shaname)
+				return req, c.serveBlob(shaname, info, req, ctx)
+			}
+			if req.Context().Err() != nil || !c.acquireFetchSlot(req.Context().Done()) {
+				ctx.Logf("Request cancelled while waiting for %s", shaname)
+				c.CancelFetch(shaname)
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusServiceUnavailable, "request cancelled")
+			}
+		}
+		if info, ok := c.fetchFromReadDirs(shaname, ctx); ok {
+			c.releaseFetchSlot()
+			return req, c.serveBlob(shaname, info, req, ctx)
+		}
+		// The secondary tier is checked before the upstream
+		if c.cfg.Secondary != nil {
+			if info, ok := c.fetchFromSecondary(shaname, ctx); ok {
+				c.releaseFetchSlot()
+				return req, c.serveBlob(shaname, info, req, ctx)
+			}
+		}
+		if len(c.cfg.Peers) > 0 {
+			if info, ok := c.fetchFromPeers(shaname, req, ctx); ok {
+				c.releaseFetchSlot()
+				return req, c.serveBlob(shaname, info, req, ctx)
+			}
+		}
+
+		atomic.AddInt64(&c.stats.Misses, 1)
+		logEvent(ctx, "miss", shaname, "MISS")
+		// Remember we are the downloader, see abortFetch
+		stateOf(ctx).fetching = shaname
+		stateOf(ctx).miss = true
+		ctx.RoundTripper = goproxy.RoundTripperFunc(c.fetchRoundTrip)
+	}
+
+	return req, nil
+}
+
+// Answers the HEAD of a cached blob without a body, returns nil to forward it:
+// docker checks the layers it may need before pulling them. A HEAD never
+// starts a download, nor waits for one.
+func (c *Cache) serveHead(shaname string, req *http.Request, ctx *goproxy.ProxyCtx) *http.Response {
+	c.mu.RLock()
+	entry := c.entries[shaname]
+	ok := entry != nil && entry.status == AVAILABLE
+	var info blobInfo
+	if ok {
+		info = entry.blobInfo
+	}
+	c.mu.RUnlock()
+	var resp *http.Response
+	if ok && (!info.private || hasCredentials(req)) {
+		resp = c.serveBlob(shaname, info, req, ctx)
+	}
+	if resp == nil {
+		ctx.Logf("HEAD of %s not in cache, forward it", shaname)
+		// The response has no body to cache
+		stateOf(ctx).handled = true
+		stateOf(ctx).miss = true
+		return nil
+	}
+	resp.Body.Close()
+	resp.Body = http.NoBody
+	return resp
+}
+
+// With Config.DiskReserve, checks that a blob of size bytes leaves the reserve
+// free. A blob of unknown size is only bounded by Config.MaxBlobSize.
+func (c *Cache) hasRoomFor(size int64, ctx *goproxy.ProxyCtx) bool {
+	if c.cfg.DiskReserve <= 0 || size < 0 {
+		return true
+	}
+	free, err := diskFree(c.dir)
+	if err != nil {
+		ctx.Warnf("Cannot check the free space of %s: %s", c.dir, err)
+		return true
+	}
+	return free-size >= c.cfg.DiskReserve
+}
+
+// Removes the entry of an AVAILABLE blob whose file is gone or does not have
+// the size of info, the bad file with it. gone is false if the file is fine,
+// broken is false if the entry was evicted or replaced since info was read.
+func (c *Cache) forgetBroken(shaname string, info blobInfo) (gone bool, broken bool) {
+	if !c.stillAvailable(shaname, info) {
+		return true, false
+	}
+	if info.inline {
+		if _, err := c.readInline(shaname); !os.IsNotExist(err) {
+			return false, false
+		}
+	} else {
+		fi, err := os.Stat(c.filePath(shaname, info))
+		if err != nil && !os.IsNotExist(err) {
+			return false, false
+		}
+		if err == nil && (info.diskSize == 0 || fi.Size() == info.diskSize) {
+			return false, false
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The entry may have been evicted or replaced by a new download meanwhile
+	if !c.isAvailable(shaname, info) {
+		return true, false
+	}
+	c.removeEntry(shaname)
+	return true, true
+}
+
+func (c *Cache) stillAvailable(shaname string, info blobInfo) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.isAvailable(shaname, info)
+}
+
+// Returns true if the entry of shaname is the AVAILABLE one of info. c.mu must be held.
+func (c *Cache) isAvailable(shaname string, info blobInfo) bool {
+	entry := c.entries[shaname]
+	return entry != nil && entry.status == AVAILABLE && entry.diskSize == info.diskSize && entry.inline == info.inline
+}
+
+// If this request was the downloader of a blob that won't be cached,
+// reset the entry to EMPTY so that a waiter can take over the download
+func (c *Cache) abortFetch(ctx *goproxy.ProxyCtx) {
+	c.endFetch(ctx, c.CancelFetch)
+}
+
+// Same as abortFetch when the upstream failed, see FailFetch
+func (c *Cache) failFetch(ctx *goproxy.ProxyCtx) {
+	c.endFetch(ctx, c.FailFetch)
+}
+
+func (c *Cache) endFetch(ctx *goproxy.ProxyCtx, end func(shaname string)) {
+	if st := stateOf(ctx); st.fetching != "" {
+		ctx.Logf("Abort download of %s", st.fetching)
+		end(st.fetching)
+		st.fetching = ""
+		c.releaseFetchSlot()
+	}
+}
+
+func (c *Cache) CacheRespHandler(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	resp = c.cacheResponse(resp, ctx)
+	if resp != nil && !c.cfg.NoCache {
+		c.setCacheHeaders(resp, ctx)
+	}
+	if c.cfg.AccessLog != nil && resp != nil {
+		c.logAccess(resp, ctx)
+	}
+	if stateOf(ctx).span != nil {
+		c.endRequestSpan(resp, ctx)
+	}
+	return resp
+}
+
+func (c *Cache) cacheResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	ctx.Logf("CacheRespHandler %s", ctx.Req.URL)
+	if resp == nil {
+		c.abortFetch(ctx)
+		return resp
+	}
+	ctx.Logf("Response headers: %v", resp.Header)
+	if c.cfg.NoCache {
+		return resp
+	}
+
+	if st := stateOf(ctx); st.upload != "" {
+		c.finishUpload(st.upload, resp, ctx)
+		return resp
+	}
+	if st := stateOf(ctx); st.hit || st.handled {
+		return resp
+	}
+
+	// Note: resp contains resp.request
+	if resp.StatusCode == http.StatusNotFound && c.cfg.NegativeTTL > 0 {
+		if _, digest := c.shouldBeCached(resp.Request.URL, ctx); digest != "" {
+			ctx.Logf("%s is unknown to the upstream for %s", digest, c.cfg.NegativeTTL)
+			c.addNegative(negativeKey(resp.Request))
+		}
+	}
+	if resp.StatusCode != 200 {
+		if transientStatus(resp.StatusCode) {
+			c.failFetch(ctx)
+		} else {
+			c.abortFetch(ctx)
+		}
+		return resp
+	}
+
+	if resp.Request.URL.Path == catalogPath && resp.Request.Method == "GET" && c.cfg.CatalogTTL > 0 {
+		return c.catalogRespHandler(resp, ctx)
+	}
+	if key := manifestShouldBeCached(resp.Request.URL.Path); key != "" && resp.Request.Method == "GET" {
+		return c.manifestRespHandler(key, resp, ctx)
+	}
+
+	if host, digest := c.shouldBeCached(resp.Request.URL, ctx); digest != "" {
+		shaname := c.blobKey(host, digest)
+		c.mu.Lock()
+		inCache := c.getEntry(shaname).status
+		c.mu.Unlock()
+
+		if inCache == AVAILABLE {
+			ctx.Logf("%s already in cache", shaname)
+		} else {
+			if max := c.cfg.MaxBlobSize; max > 0 && resp.ContentLength > max {
+				ctx.Logf("%s is too big to be cached (%d bytes)", shaname, resp.ContentLength)
+				c.abortFetch(ctx)
+				return resp
+			}
+			if min := c.cfg.MinBlobSize; resp.ContentLength >= 0 && resp.ContentLength < min {
+				ctx.Logf("%s is too small to be cached (%d bytes)", shaname, resp.ContentLength)
+				c.abortFetch(ctx)
+				return resp
+			}
+			if !c.hasRoomFor(resp.ContentLength, ctx) {
+				ctx.Warnf("Not enough free disk space to cache %s (%d bytes)", shaname, resp.ContentLength)
+				c.abortFetch(ctx)
+				return resp
+			}
+			if ct := resp.Header.Get("Content-Type"); !c.mediaTypeCached(ct) {
+				ctx.Logf("%s has the media type %s, do not cache it", shaname, ct)
+				c.abortFetch(ctx)
+				return resp
+			}
+			ctx.Logf("Should set in Cache: %s", resp.Request.URL.Path)
+			ctx.Logf("shaname=%s", shaname)
+
+			tee, err := c.newCacheTeeReader(shaname, resp, ctx)
+			if err == nil {
+				resp.Body = tee
+				// The tee now owns the download and its fetch slot
+				if st := stateOf(ctx); st.fetching == shaname {
+					tee.slot = true
+					st.fetching = ""
+				}
+			} else {
+				ctx.Warnf("newCacheTeeReader failed")
+				c.abortFetch(ctx)
+			}
+		}
+	}
+
+	return resp
+}
@@ -0,0 +1,39 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// The responses tell the clients and the proxies downstream where they come
+// from: X-Cache is HIT for a response of the cache, MISS for a cacheable one
+// fetched from the upstream. The hits of blobs and manifests have an Age, the
+// seconds since they were stored, and every hit gets Config.HitHeaders.
+
+func (c *Cache) setCacheHeaders(resp *http.Response, ctx *goproxy.ProxyCtx) {
+	st := stateOf(ctx)
+	switch {
+	case st.hit:
+		resp.Header.Set("X-Cache", "HIT")
+		for k, v := range c.cfg.HitHeaders {
+			resp.Header[k] = append([]string(nil), v...)
+		}
+	case st.miss:
+		resp.Header.Set("X-Cache", "MISS")
+	}
+}
+
+// Returns the Age header at now of a response stored at t, "" if t is unknown
+func ageSince(now, t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	age := now.Sub(t) / time.Second
+	if age < 0 {
+		age = 0
+	}
+	return strconv.FormatInt(int64(age), 10)
+}
@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Probes for Kubernetes: healthz answers as soon as the proxy port is served,
+// readyz too unless the upstream of Config.ReadyCheckURL cannot be reached.
+
+const readyCheckTimeout = 5 * time.Second
+
+func (c *Cache) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (c *Cache) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if err := c.checkUpstream(r.Context()); err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "upstream unreachable: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// Any HTTP response, even a 401, means the upstream is reachable
+func (c *Cache) checkUpstream(ctx context.Context) error {
+	if c.cfg.ReadyCheckURL == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, readyCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "HEAD", c.cfg.ReadyCheckURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.cfg.Upstream.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
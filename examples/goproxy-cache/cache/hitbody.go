@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+)
+
+// Size of the chunks a cache hit is written in
+const serveChunkSize = 64 * 1024
+
+// The body of a blob served from the cache. io.Copy hands it the destination:
+// written to a http.ResponseWriter it is flushed after each chunk, so that the
+// client of a big blob sees a steady progress. In a MITM'd tunnel goproxy
+// writes the chunks straight to the TLS connection.
+//
+// A blob stored as is, without rate limit, is handed to the ReadFrom of the
+// destination instead: net/http then sends the file with sendfile(2) when the
+// response has a Content-Length and goes to a plain TCP connection, and falls
+// back to a copy otherwise.
+type hitBody struct {
+	io.ReadCloser
+	limiter *rateLimiter // nil means unlimited
+	served  *int64
+	release func() // if set, called once the body is closed, see Cache.acquire
+}
+
+func (b *hitBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.release != nil {
+		b.release()
+		b.release = nil
+	}
+	return err
+}
+
+func (b *hitBody) Read(p []byte) (int, error) {
+	if b.limiter != nil && len(p) > int(b.limiter.burst) {
+		p = p[:int(b.limiter.burst)]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if b.limiter != nil {
+			b.limiter.wait(n)
+		}
+		atomic.AddInt64(b.served, int64(n))
+	}
+	return n, err
+}
+
+func (b *hitBody) WriteTo(dst io.Writer) (int64, error) {
+	if rf, ok := dst.(io.ReaderFrom); ok && b.limiter == nil {
+		if src := fileSource(b.ReadCloser); src != nil {
+			n, err := rf.ReadFrom(src)
+			atomic.AddInt64(b.served, n)
+			return n, err
+		}
+	}
+	flusher, _ := dst.(http.Flusher)
+	buf := make([]byte, serveChunkSize)
+	var written int64
+	for {
+		n, err := b.Read(buf)
+		if n > 0 {
+			nw, werr := dst.Write(buf[:n])
+			written += int64(nw)
+			if werr != nil {
+				return written, werr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// Returns the file, or the range of it, read by body, or nil if it is not a
+// plain file
+func fileSource(body io.Reader) io.Reader {
+	switch r := body.(type) {
+	case *os.File:
+		return r
+	case sectionReadCloser:
+		if lr, ok := r.Reader.(*io.LimitedReader); ok {
+			if _, ok := lr.R.(*os.File); ok {
+				return lr
+			}
+		}
+	}
+	return nil
+}
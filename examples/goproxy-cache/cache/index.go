@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sync/atomic"
+	"time"
+)
+
+// The index keeps the blob metadata that the directory listing cannot give back
+// after a restart. It is only a hint: files not in the index, or whose size
+// disagrees with it, are verified like before.
+
+const indexName = ".index.json"
+
+var blobNameRe = regexp.MustCompile("^[a-f0-9]{64}$")
+
+type indexEntry struct {
+	Size          int64     `json:"size"`
+	DiskSize      int64     `json:"disk_size,omitempty"`
+	Compressed    bool      `json:"compressed,omitempty"`
+	Private       bool      `json:"private,omitempty"`
+	Atime         time.Time `json:"atime"`
+	Hits          int64     `json:"hits,omitempty"`
+	ContentType   string    `json:"content_type,omitempty"`
+	ContentDigest string    `json:"content_digest,omitempty"`
+}
+
+// Indexes written before compression was supported have no disk_size
+func (meta indexEntry) diskSize() int64 {
+	if meta.DiskSize == 0 {
+		return meta.Size
+	}
+	return meta.DiskSize
+}
+
+type cacheIndex struct {
+	Blobs map[string]indexEntry `json:"blobs"`
+}
+
+// Returns nil if the index is missing or corrupt
+func (c *Cache) loadIndex() *cacheIndex {
+	data, err := ioutil.ReadFile(c.dir + indexName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("Cannot read index: %s\n", err)
+		}
+		return nil
+	}
+
+	var index cacheIndex
+	if err := json.Unmarshal(data, &index); err != nil || index.Blobs == nil {
+		fmt.Printf("Corrupt index %s, ignore it\n", c.dir+indexName)
+		return nil
+	}
+	return &index
+}
+
+// Writes the metadata of the AVAILABLE entries, atomically replacing the previous index
+func (c *Cache) saveIndex() error {
+	index := cacheIndex{Blobs: make(map[string]indexEntry)}
+	c.mu.RLock()
+	for shaname, entry := range c.entries {
+		if entry.status == AVAILABLE && entry.readDir == "" {
+			index.Blobs[shaname] = indexEntry{
+				Size:          entry.size,
+				DiskSize:      entry.diskSize,
+				Compressed:    entry.compressed,
+				Private:       entry.private,
+				Atime:         entry.atime,
+				Hits:          atomic.LoadInt64(&entry.hits),
+				ContentType:   entry.contentType,
+				ContentDigest: entry.contentDigest,
+			}
+		}
+	}
+	c.mu.RUnlock()
+
+	data, err := json.Marshal(&index)
+	if err != nil {
+		return err
+	}
+	tmp := c.dir + indexName + ".tmp"
+	f, err := createMode(tmp, c.cfg.FileMode)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.dir+indexName)
+}
+
+func (c *Cache) SaveIndexEvery(period time.Duration) {
+	ticker := c.cfg.Clock.NewTicker(period)
+	defer ticker.Stop()
+	for range ticker.Chan() {
+		if err := c.saveIndex(); err != nil {
+			fmt.Printf("Cannot save index: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// With Config.InlineBlobSize the blobs up to that size are stored in
+// <dir>/inline.db, a bbolt database, rather than in a file each: a cache
+// dominated by small blobs (image configs, tiny layers) would otherwise use
+// millions of inodes. A blob is downloaded to a file like any other and moved
+// into the database by CompleteFetch, once it is verified. The metadata of all
+// the blobs stays in the index.
+//
+// bbolt locks its file: a cache directory with inline blobs cannot be shared
+// by several processes.
+
+const inlineDBName = "inline.db"
+
+var inlineBucket = []byte("blobs")
+
+func (c *Cache) openInlineDB() error {
+	db, err := bolt.Open(c.dir+inlineDBName, c.cfg.FileMode, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("cannot open %s: %s", c.dir+inlineDBName, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(inlineBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	c.db = db
+	return nil
+}
+
+// Moves the file of a verified blob into the database if it is small enough
+func (c *Cache) inline(shaname string, info *blobInfo) {
+	if c.db == nil || info.inline || info.readDir != "" || info.diskSize > c.cfg.InlineBlobSize {
+		return
+	}
+	fname := c.blobPath(shaname)
+	data, err := ioutil.ReadFile(fname)
+	if err != nil || int64(len(data)) > c.cfg.InlineBlobSize {
+		return
+	}
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(inlineBucket).Put([]byte(shaname), data)
+	})
+	if err != nil {
+		fmt.Printf("Cannot store %s in %s: %s\n", shaname, inlineDBName, err)
+		return
+	}
+	os.Remove(fname)
+	info.inline = true
+	info.diskSize = int64(len(data))
+}
+
+// Returns the content of an inline blob, os.ErrNotExist if it is not stored
+func (c *Cache) readInline(shaname string) ([]byte, error) {
+	var data []byte
+	err := c.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(inlineBucket).Get([]byte(shaname)); v != nil {
+			// v is only valid during the transaction
+			data = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if err == nil && data == nil {
+		err = os.ErrNotExist
+	}
+	return data, err
+}
+
+func (c *Cache) deleteInline(shaname string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(inlineBucket).Delete([]byte(shaname))
+	})
+}
+
+// Loads the entries of the inline blobs, the bad ones are dropped. A blob also
+// stored as a file, if the move was interrupted, is already loaded by load.
+func (c *Cache) loadInline(index *cacheIndex) error {
+	var bad []string
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(inlineBucket).ForEach(func(k, v []byte) error {
+			shaname := string(k)
+			if entry := c.entries[shaname]; entry != nil && entry.status == AVAILABLE {
+				bad = append(bad, shaname)
+				return nil
+			}
+			fmt.Printf("cache: %s (inline)\n", shaname)
+			meta, indexed := indexEntry{}, false
+			if index != nil {
+				meta, indexed = index.Blobs[shaname]
+			}
+			if c.cfg.VerifyOnStart || !indexed || meta.diskSize() != int64(len(v)) {
+				info, err := verifyReader(bytes.NewReader(v), digestOf(shaname))
+				if err != nil {
+					fmt.Printf("Discard %s: %s\n", shaname, err)
+					bad = append(bad, shaname)
+					return nil
+				}
+				if !indexed || meta.diskSize() != int64(len(v)) {
+					meta = indexEntry{Atime: c.cfg.Clock.Now()}
+				}
+				meta.Size, meta.Compressed = info.size, info.compressed
+			}
+
+			entry := c.getEntry(shaname)
+			entry.status = AVAILABLE
+			entry.inline = true
+			entry.size = meta.Size
+			entry.diskSize = int64(len(v))
+			entry.compressed = meta.Compressed
+			entry.private = meta.Private
+			entry.atime = meta.Atime
+			entry.hits = meta.Hits
+			entry.contentType = meta.ContentType
+			entry.contentDigest = meta.ContentDigest
+			entry.stored = meta.Atime
+			c.totalSize += entry.diskSize
+			c.available++
+			return nil
+		})
+	})
+	for _, shaname := range bad {
+		c.deleteInline(shaname)
+	}
+	return err
+}
+
+type readSeekCloser interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// The body of an inline blob
+type nopSeekCloser struct {
+	*bytes.Reader
+}
+
+func (nopSeekCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// A download in progress is also recorded on disk by a <digest>.lock file next
+// to the blob, so that the instances sharing the cache directory, or a
+// restarted one, do not fetch and write the same blob at the same time.
+//
+// The lock holds the pid, the host name and the start time of its process: a
+// lock of a process of this host which is gone is stale right away, even when
+// the restarted container has the same pid. The locks of the other hosts, and
+// the empty ones of the older versions, are stale once not refreshed.
+
+var (
+	// A lock not refreshed for this long belongs to a dead download
+	lockStaleAfter = 10 * time.Minute
+	// How often a waiter checks whether the lock is gone
+	lockPollPeriod = time.Second
+)
+
+// The content of the locks of this process
+var lockOwner = newLockOwner()
+
+func newLockOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%d %s %d", os.Getpid(), host, time.Now().UnixNano())
+}
+
+func (c *Cache) lockPath(shaname string) string {
+	return c.blobPath(shaname) + ".lock"
+}
+
+func (c *Cache) lockFresh(shaname string) bool {
+	fi, err := os.Stat(c.lockPath(shaname))
+	if err != nil || time.Since(fi.ModTime()) >= lockStaleAfter {
+		return false
+	}
+	owner, err := ioutil.ReadFile(c.lockPath(shaname))
+	return err != nil || !deadOwner(strings.TrimSpace(string(owner)))
+}
+
+// Returns true if owner is a process of this host which is gone
+func deadOwner(owner string) bool {
+	var pid int
+	var host string
+	var start int64
+	if _, err := fmt.Sscan(owner, &pid, &host, &start); err != nil || owner == lockOwner {
+		return false
+	}
+	if host != strings.Fields(lockOwner)[1] {
+		return false
+	}
+	// A previous run with the same pid
+	if pid == os.Getpid() {
+		return true
+	}
+	return !processAlive(pid)
+}
+
+// Atomically creates the lock of a download, taking over a stale one.
+// Returns false if another process holds a fresh lock.
+func (c *Cache) createLock(shaname string) (bool, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(c.lockPath(shaname), os.O_CREATE|os.O_EXCL|os.O_WRONLY, c.cfg.FileMode)
+		if err == nil {
+			fmt.Fprintln(f, lockOwner)
+			return true, f.Close()
+		}
+		if !os.IsExist(err) {
+			return false, err
+		}
+		if c.lockFresh(shaname) {
+			return false, nil
+		}
+		// Two processes may take over the same stale lock; the O_EXCL
+		// creation still lets only one of them win most of the time
+		os.Remove(c.lockPath(shaname))
+	}
+	return false, nil
+}
+
+// Keeps the lock of a long download fresh
+func (c *Cache) touchLock(shaname string) {
+	now := time.Now()
+	os.Chtimes(c.lockPath(shaname), now, now)
+}
+
+func (c *Cache) removeLock(shaname string) {
+	if err := os.Remove(c.lockPath(shaname)); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Cannot remove lock of %s: %s\n", shaname, err)
+	}
+}
+
+// Removes the lock of shaname if this process holds it, not the lock of
+// another process this one is waiting for
+func (c *Cache) removeOwnLock(shaname string) {
+	if owner, err := ioutil.ReadFile(c.lockPath(shaname)); err == nil && strings.TrimSpace(string(owner)) == lockOwner {
+		c.removeLock(shaname)
+	}
+}
+
+// Waits while another process holds a fresh lock on a blob which is
+// IN_PROGRESS here. Returns true once the blob it downloaded is verified
+// and AVAILABLE; false if there is no lock, the download failed or ctx is done.
+func (c *Cache) waitForLock(ctx context.Context, shaname string) (blobInfo, bool) {
+	if !c.lockFresh(shaname) {
+		return blobInfo{}, false
+	}
+
+	ticker := time.NewTicker(lockPollPeriod)
+	defer ticker.Stop()
+	for c.lockFresh(shaname) {
+		select {
+		case <-ctx.Done():
+			return blobInfo{}, false
+		case <-ticker.C:
+		}
+	}
+
+	info, err := verifyBlob(c.blobPath(shaname), digestOf(shaname))
+	if err != nil {
+		return blobInfo{}, false
+	}
+	return c.CompleteFetch(shaname, info), true
+}
@@ -0,0 +1,172 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// With -log-format json, the goproxy log lines and the cache events are
+// written as JSON records. The default text format is left untouched.
+//
+// The log level maps on goproxy: ProxyCtx.Logf is debug and ProxyCtx.Warnf
+// is warn. The cache events, one per hit or miss, are info. proxy.Verbose is
+// only set at LevelDebug, Logf formats nothing otherwise; it is set once at
+// startup, the request goroutines read it without a lock. A reload to a lower
+// level drops the debug lines in the writers, a reload to LevelDebug needs a
+// restart.
+
+var jsonLog *slog.Logger // nil in text format
+
+var textLog *log.Logger // the logger of the proxy in text format
+
+// A LogLevel, changed by SetLogLevel while the proxy runs: always accessed
+// with sync/atomic
+var logLevel = int32(LevelInfo)
+
+// proxy.Verbose, set by SetupLogging
+var debugLogs bool
+
+// The level of jsonLog, follows logLevel
+var jsonLevel slog.LevelVar
+
+// Returns the level set by SetLogLevel
+func CurrentLogLevel() LogLevel {
+	return LogLevel(atomic.LoadInt32(&logLevel))
+}
+
+type LogLevel int
+
+const (
+	LevelError LogLevel = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+)
+
+var logLevelNames = []string{"error", "warn", "info", "debug"}
+
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, name := range logLevelNames {
+		if s == name {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q (%s)", s, strings.Join(logLevelNames, ", "))
+}
+
+func (l LogLevel) slogLevel() slog.Level {
+	return []slog.Level{slog.LevelError, slog.LevelWarn, slog.LevelInfo, slog.LevelDebug}[l]
+}
+
+// Drops the info lines of goproxy below LevelDebug and its warn lines below
+// LevelWarn
+type levelWriter struct {
+	w io.Writer
+}
+
+func (w levelWriter) Write(p []byte) (int, error) {
+	level := CurrentLogLevel()
+	if level < LevelDebug && bytes.Contains(p, []byte("] INFO: ")) {
+		return len(p), nil
+	}
+	if level < LevelWarn && bytes.Contains(p, []byte("] WARN: ")) {
+		return len(p), nil
+	}
+	return w.w.Write(p)
+}
+
+// Parses the "[%03d] INFO: msg" lines of ProxyCtx.Logf and Warnf
+var proxyLineRe = regexp.MustCompile(`^\[(\d+)\] (INFO|WARN): (.*)$`)
+
+// Turns the lines written by goproxy in JSON records
+type slogWriter struct {
+	logger *slog.Logger
+}
+
+func (w slogWriter) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	if res := proxyLineRe.FindStringSubmatch(line); res != nil {
+		session, _ := strconv.Atoi(res[1])
+		level := slog.LevelDebug
+		if res[2] == "WARN" {
+			level = slog.LevelWarn
+		}
+		w.logger.Log(context.Background(), level, res[3], "session", session)
+	} else {
+		w.logger.Info(line)
+	}
+	return len(p), nil
+}
+
+func SetupLogging(format string, level LogLevel, proxy *goproxy.ProxyHttpServer) {
+	debugLogs = level >= LevelDebug
+	proxy.Verbose = debugLogs
+	SetLogLevel(level)
+	switch format {
+	case "text":
+		proxy.Logger = log.New(levelWriter{os.Stderr}, "", log.LstdFlags)
+		textLog = proxy.Logger
+	case "json":
+		jsonLog = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: &jsonLevel}))
+		proxy.Logger = log.New(slogWriter{jsonLog}, "", 0)
+	default:
+		log.Fatalf("Unknown log format %q (text or json)", format)
+	}
+}
+
+// Changes the level of the logs set up by SetupLogging, e.g. on a reload
+func SetLogLevel(level LogLevel) {
+	if level >= LevelDebug && !debugLogs && CurrentLogLevel() < LevelDebug {
+		fmt.Printf("Restart with the debug level to get the debug lines\n")
+	}
+	atomic.StoreInt32(&logLevel, int32(level))
+	jsonLevel.Set(level.slogLevel())
+}
+
+// Logs a cache event at LevelInfo, as a structured record in JSON format
+func logEvent(ctx *goproxy.ProxyCtx, event string, digest string, cacheStatus string, attrs ...interface{}) {
+	if CurrentLogLevel() < LevelInfo {
+		return
+	}
+	if jsonLog == nil {
+		if textLog != nil {
+			textLog.Print(textEvent(ctx, event, digest, cacheStatus, attrs))
+		}
+		return
+	}
+	args := []interface{}{"event", event, "digest", digest, "cache_status", cacheStatus}
+	if ctx != nil {
+		args = append(args, "session", ctx.Session)
+	}
+	jsonLog.Info(event, append(args, attrs...)...)
+}
+
+// Formats the duration field of the events
+func since(start time.Time) string {
+	return time.Since(start).Round(time.Millisecond).String()
+}
+
+// Formats an event like the lines of ProxyCtx.Logf: [session] STATUS: event digest key=value...
+func textEvent(ctx *goproxy.ProxyCtx, event string, digest string, cacheStatus string, attrs []interface{}) string {
+	var session int64
+	if ctx != nil {
+		session = ctx.Session
+	}
+	line := fmt.Sprintf("[%03d] %s: %s %s", session, cacheStatus, event, digest)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		line += fmt.Sprintf(" %v=%v", attrs[i], attrs[i+1])
+	}
+	return line
+}
@@ -0,0 +1,265 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Manifests are small: they are kept in memory, keyed by registry, repository
+// and reference. Digest-pinned manifests are immutable and cached until
+// maxManifests is reached, tags are mutable and expire after
+// Config.ManifestTTL.
+
+var manifestRe = regexp.MustCompile("^/v2/(?P<name>.+)/manifests/(?P<ref>[^/]+)$")
+
+const (
+	// Do not keep abnormally big manifests in memory
+	maxManifestSize = 4 << 20
+	// Bound of the manifest entries, the expired tags are dropped first
+	maxManifests = 4096
+)
+
+type manifestEntry struct {
+	body    []byte
+	header  http.Header
+	fetched time.Time
+	pinned  bool // reference is a digest
+	private bool // fetched with credentials, see auth.go
+}
+
+// Returns "" or the cache key of the manifest: <name>@<ref>
+func manifestShouldBeCached(urlpath string) string {
+	if res := manifestRe.FindStringSubmatch(urlpath); res != nil && len(res) > 2 {
+		return res[1] + "@" + res[2]
+	}
+	return ""
+}
+
+// A manifest reference is either a tag or a digest like sha256:<hex>
+func isDigestRef(key string) bool {
+	return strings.Contains(key[strings.LastIndex(key, "@")+1:], ":")
+}
+
+// Two registries may serve the same name and reference. The registry
+// negotiates the manifest schema with the Accept header, so it must be part
+// of the key too, and so must the credentials of a private manifest.
+func manifestKey(req *http.Request, key string, private bool) string {
+	mkey := req.URL.Host + "/" + key + " " + strings.Join(req.Header["Accept"], ",")
+	if private {
+		mkey += " " + authHash(req)
+	}
+	return mkey
+}
+
+func (entry *manifestEntry) fresh(now time.Time, ttl time.Duration) bool {
+	return entry.pinned || now.Sub(entry.fetched) < ttl
+}
+
+// Returns the response to serve, or nil to forward the request. hit is false
+// when the response comes from the upstream after a failed revalidation.
+func (c *Cache) manifestReqHandler(key string, req *http.Request, ctx *goproxy.ProxyCtx) (resp *http.Response, hit bool) {
+	// A stored entry is never changed, a revalidation replaces it: this
+	// request uses its own copy
+	c.mm.RLock()
+	mkey := manifestKey(req, key, false)
+	stored := c.manifests[mkey]
+	if stored == nil && hasCredentials(req) {
+		mkey = manifestKey(req, key, true)
+		stored = c.manifests[mkey]
+	}
+	var entry *manifestEntry
+	if stored != nil {
+		copied := *stored
+		entry = &copied
+	}
+	c.mm.RUnlock()
+
+	if entry == nil {
+		ctx.Logf("Manifest %s not in cache", key)
+		return nil, false
+	}
+	fresh := entry.fresh(c.cfg.Clock.Now(), c.cfg.ManifestTTL)
+	if !fresh {
+		if !c.cfg.ManifestRevalidate || entry.header.Get("Etag") == "" {
+			ctx.Logf("Manifest %s expired", key)
+			if c.cfg.ServeStaleOnError {
+				ctx.RoundTripper = c.staleFallback(key, entry)
+			}
+			return nil, false
+		}
+		if resp, notModified := c.revalidateManifest(key, mkey, entry, req, ctx); !notModified {
+			if c.cfg.ServeStaleOnError && (resp == nil || transientStatus(resp.StatusCode)) {
+				if resp != nil {
+					resp.Body.Close()
+				}
+				return c.staleResponse(key, entry, req, ctx), true
+			}
+			return resp, false
+		}
+	}
+
+	ctx.Logf("Manifest %s in cache: return it !", key)
+	c.prefetchLayers(key, entry.body, req)
+	return c.manifestResponse(entry, req), true
+}
+
+func (c *Cache) manifestResponse(entry *manifestEntry, req *http.Request) *http.Response {
+	resp := &http.Response{}
+	resp.Request = req
+	resp.TransferEncoding = req.TransferEncoding
+	resp.Header = make(http.Header)
+	for k, v := range entry.header {
+		resp.Header[k] = v
+	}
+	resp.Header.Set("Age", ageSince(c.cfg.Clock.Now(), entry.fetched))
+	resp.StatusCode = 200
+	resp.ContentLength = int64(len(entry.body))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(entry.body))
+	return resp
+}
+
+// With Config.ServeStaleOnError an expired manifest is still served when the
+// upstream cannot be reached or answers with a transient error, with a Warning
+// header telling the client it may be out of date.
+func (c *Cache) staleResponse(key string, entry *manifestEntry, req *http.Request, ctx *goproxy.ProxyCtx) *http.Response {
+	ctx.Warnf("Upstream unavailable, serve the stale manifest %s", key)
+	resp := c.manifestResponse(entry, req)
+	resp.Header.Set("Warning", `110 - "Response is Stale"`)
+	return resp
+}
+
+// Forwards the request of an expired manifest, falling back to the stale copy
+func (c *Cache) staleFallback(key string, entry *manifestEntry) goproxy.RoundTripper {
+	return goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		resp, err := c.cfg.Upstream.RoundTrip(req)
+		if err == nil && !transientStatus(resp.StatusCode) {
+			return resp, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+		// The response handlers must not store it again as a fresh copy
+		stateOf(ctx).hit = true
+		return c.staleResponse(key, entry, req, ctx), nil
+	})
+}
+
+// Asks the upstream whether an expired tag still points to the cached manifest.
+// On 304 the entry, a copy of the one stored at mkey, is refreshed and replaces
+// it so that it can be served from the cache.
+// Otherwise the upstream response is returned (and stored if it is a 200),
+// or nil if the upstream cannot be reached.
+func (c *Cache) revalidateManifest(key string, mkey string, entry *manifestEntry, req *http.Request, ctx *goproxy.ProxyCtx) (resp *http.Response, notModified bool) {
+	creq := req.Clone(req.Context())
+	creq.Header.Set("If-None-Match", entry.header.Get("Etag"))
+	resp, err := c.cfg.Upstream.RoundTrip(creq)
+	if err != nil {
+		ctx.Warnf("Cannot revalidate manifest %s: %s", key, err)
+		return nil, false
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		ctx.Logf("Manifest %s not modified", key)
+		entry.fetched = c.cfg.Clock.Now()
+		c.mm.Lock()
+		c.manifests[mkey] = entry
+		c.mm.Unlock()
+		return nil, true
+	}
+	resp.Request = req
+	if resp.StatusCode != 200 {
+		ctx.Logf("Revalidation of manifest %s returned %s", key, resp.Status)
+		return resp, false
+	}
+	ctx.Logf("Manifest %s modified", key)
+	return c.manifestRespHandler(key, resp, ctx), false
+}
+
+func (c *Cache) manifestRespHandler(key string, resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp.ContentLength > maxManifestSize {
+		ctx.Logf("Manifest %s too big to be cached", key)
+		return resp
+	}
+
+	// The Content-Length may be unknown
+	body, rest, err := readBounded(resp.Body, maxManifestSize)
+	resp.Body = rest
+	if err != nil {
+		ctx.Warnf("Cannot read manifest %s: %s", key, err)
+		return resp
+	}
+	if body == nil {
+		ctx.Logf("Manifest %s too big to be cached", key)
+		return resp
+	}
+
+	entry := &manifestEntry{
+		body:    body,
+		header:  make(http.Header),
+		fetched: c.cfg.Clock.Now(),
+		pinned:  isDigestRef(key),
+		private: hasCredentials(resp.Request),
+	}
+	for _, k := range []string{"Content-Type", "Docker-Content-Digest", "Etag"} {
+		if v := resp.Header.Get(k); v != "" {
+			entry.header.Set(k, v)
+		}
+	}
+	// Unlike a blob, a manifest pulled by tag is not named by its digest
+	if entry.header.Get("Docker-Content-Digest") == "" {
+		sum := sha256.Sum256(body)
+		entry.header.Set("Docker-Content-Digest", "sha256:"+hex.EncodeToString(sum[:]))
+	}
+
+	ctx.Logf("Store manifest %s in cache", key)
+	c.storeManifest(manifestKey(resp.Request, key, entry.private), entry)
+	c.learnBlobSizes(resp.Request.URL.Host, body)
+	c.prefetchLayers(key, body, resp.Request)
+
+	return resp
+}
+
+func (c *Cache) storeManifest(mkey string, entry *manifestEntry) {
+	now := c.cfg.Clock.Now()
+	c.mm.Lock()
+	defer c.mm.Unlock()
+	if len(c.manifests) >= maxManifests {
+		for key, old := range c.manifests {
+			if !old.fresh(now, c.cfg.ManifestTTL) {
+				delete(c.manifests, key)
+			}
+		}
+		for key := range c.manifests {
+			if len(c.manifests) < maxManifests {
+				break
+			}
+			delete(c.manifests, key)
+		}
+	}
+	c.manifests[mkey] = entry
+}
+
+// Reads body if it has limit bytes at most, and returns a ReadCloser sending
+// the bytes read. The body of a bigger one is nil and the ReadCloser sends the
+// bytes read then the rest of body, which is left open.
+func readBounded(body io.ReadCloser, limit int64) ([]byte, io.ReadCloser, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil || int64(len(data)) <= limit {
+		body.Close()
+		return data, ioutil.NopCloser(bytes.NewReader(data)), err
+	}
+	return nil, struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), body), body}, nil
+}
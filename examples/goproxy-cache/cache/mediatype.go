@@ -0,0 +1,45 @@
+package cache
+
+import (
+	"mime"
+	"strings"
+)
+
+// The layers and configs are cached whatever their media type, most registries
+// serve them as application/octet-stream. The signatures and attestations are
+// small, pushed often and may be replaced: they are not cached by default.
+// A media type pattern ending with a * matches any type with that prefix.
+var defaultDeniedMediaTypes = []string{
+	"application/vnd.dev.cosign.simplesigning.v1+json",
+	"application/vnd.dev.sigstore.bundle*",
+	"application/vnd.in-toto+json",
+	"application/vnd.dsse.envelope.v1+json",
+	// Non-distributable layers must not be redistributed
+	"application/vnd.docker.image.rootfs.foreign.diff.tar*",
+	"application/vnd.oci.image.layer.nondistributable.*",
+}
+
+func mediaTypeMatch(patterns []string, mediaType string) bool {
+	for _, p := range patterns {
+		if p == mediaType || strings.HasSuffix(p, "*") && strings.HasPrefix(mediaType, strings.TrimSuffix(p, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// With Config.AllowMediaTypes only the listed types are cached, the default
+// denied ones included; otherwise every type but the denied ones is cached.
+func (c *Cache) mediaTypeCached(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	if mediaTypeMatch(c.cfg.DenyMediaTypes, mediaType) {
+		return false
+	}
+	if len(c.cfg.AllowMediaTypes) > 0 {
+		return mediaTypeMatch(c.cfg.AllowMediaTypes, mediaType)
+	}
+	return !mediaTypeMatch(defaultDeniedMediaTypes, mediaType)
+}
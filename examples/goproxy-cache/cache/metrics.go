@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The Prometheus collectors read the same counters as /_cache/stats
+func NewMetricsRegistry(c *Cache) *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	counter := func(name, help string, v *int64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help}, func() float64 {
+			return float64(atomic.LoadInt64(v))
+		})
+	}
+
+	reg.MustRegister(
+		counter("cache_hits_total", "Requests served from the cache.", &c.stats.Hits),
+		counter("cache_misses_total", "Requests forwarded to the upstream.", &c.stats.Misses),
+		counter("cache_bytes_served_total", "Bytes served from the cache.", &c.stats.BytesServed),
+		counter("cache_in_progress_waits_total", "Requests which waited for the download of a blob.", &c.stats.Waits),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "cache_waiting_requests", Help: "Requests waiting for the download of a blob."}, func() float64 {
+			return float64(atomic.LoadInt64(&c.stats.Waiting))
+		}),
+		waitCollector{&c.stats.WaitTime, prometheus.NewDesc("cache_wait_duration_seconds", "How long the requests waited for the download of a blob.", nil, nil)},
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "cache_entries", Help: "Blobs available in the cache."}, func() float64 {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+			return float64(c.available)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "cache_size_bytes", Help: "Bytes used by the cached blobs."}, func() float64 {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+			return float64(c.totalSize)
+		}),
+	)
+	return reg
+}
+
+// Exports a waitHistogram
+type waitCollector struct {
+	h    *waitHistogram
+	desc *prometheus.Desc
+}
+
+func (w waitCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- w.desc
+}
+
+func (w waitCollector) Collect(ch chan<- prometheus.Metric) {
+	h := w.h.snapshot()
+	ch <- prometheus.MustNewConstHistogram(w.desc, uint64(h.count), time.Duration(h.sum).Seconds(), h.cumulative())
+}
+
+func MetricsHandler(reg *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+}
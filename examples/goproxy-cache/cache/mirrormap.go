@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/elazarl/goproxy"
+)
+
+// With Config.MirrorMap the requests for a registry host are sent to another
+// host, e.g. registry-1.docker.io=mirror.internal sends the Docker Hub pulls
+// to an internal mirror. Only the upstream request is rewritten: its URL, so
+// the TLS server name, and its Host header. The handlers, the cache keys and
+// the client keep seeing the original host.
+
+type mirrorTransport struct {
+	http.RoundTripper
+	c *Cache
+}
+
+// Returns the mirror of host, empty if it is not mapped. The port of host is
+// kept if the mirror does not name one.
+func mirrorHost(hosts map[string]string, host string) string {
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		name, port = host, ""
+	}
+	mirror, ok := hosts[name]
+	if !ok {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(mirror); err == nil || port == "" {
+		return mirror
+	}
+	return net.JoinHostPort(mirror, port)
+}
+
+func (c *Cache) mirrorMap() map[string]string {
+	c.rm.RLock()
+	defer c.rm.RUnlock()
+	return c.mirrors
+}
+
+func (t *mirrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	hosts := t.c.mirrorMap()
+	host := mirrorHost(hosts, req.URL.Host)
+	if host == "" {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	mreq := req.Clone(req.Context())
+	mreq.URL.Host = host
+	// The client may not have sent the port
+	if mreq.Host = mirrorHost(hosts, req.Host); mreq.Host == "" {
+		mreq.Host = host
+	}
+	resp, err := t.RoundTripper.RoundTrip(mreq)
+	if resp != nil {
+		resp.Request = req
+	}
+	return resp, err
+}
+
+// The requests without a RoundTripper of their own would be sent with the
+// transport of the proxy, they go through Config.Upstream instead
+func (c *Cache) mirrorReqHandler(req *http.Request, ctx *goproxy.ProxyCtx) {
+	mirror := mirrorHost(c.mirrorMap(), req.URL.Host)
+	if mirror == "" {
+		return
+	}
+	ctx.Logf("Send %s to the mirror %s", req.URL, mirror)
+	ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		return c.cfg.Upstream.RoundTrip(req)
+	})
+}
@@ -0,0 +1,38 @@
+package cache
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// A push reusing a blob of another repository asks the registry to mount it:
+// POST /v2/<name>/blobs/uploads/?mount=<digest>&from=<repository>. The mount is
+// always forwarded, even when the blob is cached: the registry must link the
+// blob into <name> itself, a 201 made up by the proxy would let the push go
+// on until the manifest PUT fails with BLOB_UNKNOWN. The blobs of such pushes
+// are never uploaded through the cache either, so there is nothing to gain.
+
+var mountRe = regexp.MustCompile("^/v2/.+/blobs/uploads/?$")
+
+// Returns the digest of a blob mount request, or ""
+func blobMount(req *http.Request) string {
+	if req.Method != "POST" || !mountRe.MatchString(req.URL.Path) {
+		return ""
+	}
+	return req.URL.Query().Get("mount")
+}
+
+func (c *Cache) logBlobMount(digest string, req *http.Request, ctx *goproxy.ProxyCtx) {
+	shaname := strings.TrimPrefix(digest, "sha256:")
+	cached := false
+	if blobNameRe.MatchString(shaname) {
+		c.mu.RLock()
+		entry := c.entries[c.blobKey(req.URL.Host, shaname)]
+		cached = entry != nil && entry.status == AVAILABLE
+		c.mu.RUnlock()
+	}
+	ctx.Logf("Forward mount of %s from %s (cached: %v)", digest, req.URL.Query().Get("from"), cached)
+}
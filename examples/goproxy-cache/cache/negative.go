@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// With Config.NegativeTTL, the 404 of the upstream for a blob is remembered
+// for a short while and served locally. The negative entries are kept apart
+// from the blobs and keyed by URL, not digest: a blob missing from one
+// repository may exist in another, and once the TTL expires the next request
+// goes to the upstream again. A registry may answer a 404 to the clients
+// without the rights on the repository, so the key includes the
+// Authorization header as well, like catalogKey.
+
+// Bound of the negative entries, the oldest ones are dropped first
+const maxNegatives = 4096
+
+// Returns true if u got a 404 from the upstream less than NegativeTTL ago
+func (c *Cache) isNegative(u string) bool {
+	if c.cfg.NegativeTTL <= 0 {
+		return false
+	}
+	c.nm.Lock()
+	defer c.nm.Unlock()
+	expires, ok := c.negatives[u]
+	if ok && c.cfg.Clock.Now().After(expires) {
+		delete(c.negatives, u)
+		return false
+	}
+	return ok
+}
+
+// Records a 404 of the upstream for u
+func (c *Cache) addNegative(u string) {
+	if c.cfg.NegativeTTL <= 0 {
+		return
+	}
+	now := c.cfg.Clock.Now()
+	c.nm.Lock()
+	defer c.nm.Unlock()
+	if len(c.negatives) >= maxNegatives {
+		c.pruneNegatives(now)
+	}
+	c.negatives[u] = now.Add(c.cfg.NegativeTTL)
+}
+
+// Drops the expired negative entries, or the oldest one if none has expired.
+// c.nm must be held.
+func (c *Cache) pruneNegatives(now time.Time) {
+	var oldest string
+	var oldestExpires time.Time
+	for u, expires := range c.negatives {
+		if now.After(expires) {
+			delete(c.negatives, u)
+		} else if oldest == "" || expires.Before(oldestExpires) {
+			oldest, oldestExpires = u, expires
+		}
+	}
+	if len(c.negatives) >= maxNegatives {
+		delete(c.negatives, oldest)
+	}
+}
+
+// The 404 served for a negative entry, in the format of the distribution spec
+func blobUnknown(req *http.Request, shaname string) *http.Response {
+	body, _ := json.Marshal(map[string]interface{}{
+		"errors": []map[string]string{{
+			"code":    "BLOB_UNKNOWN",
+			"message": "blob unknown to registry",
+			"detail":  "sha256:" + digestOf(shaname),
+		}},
+	})
+	resp := goproxy.NewResponse(req, "application/json", http.StatusNotFound, string(body))
+	resp.Header.Set("Docker-Distribution-Api-Version", "registry/2.0")
+	return resp
+}
+
+// The key of a negative entry
+func negativeKey(req *http.Request) string {
+	return req.URL.Host + req.URL.Path + " " + authHash(req)
+}
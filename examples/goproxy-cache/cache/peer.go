@@ -0,0 +1,155 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// With Config.Peers, the proxies of a fleet form a cache mesh: on a local
+// miss the blob is asked to each peer in turn, on the read-only
+// /_cache/peer/blobs/[host/]sha256:<hex> route of its proxy port, before the
+// upstream. A peer only answers with the blobs it has, it never fetches one
+// itself, so that two peers missing a blob cannot ask each other forever.
+// The answer is copied to the disk and verified before it is served, like a
+// blob of the secondary tier: a peer which answers a broken or truncated blob
+// is skipped, and the upstream is the fallback. A peer which does not answer
+// within Config.PeerTimeout is skipped, Config.FetchTimeout bounds the copy.
+//
+// Blobs fetched with credentials are never served to the peers.
+
+const defaultPeerTimeout = 2 * time.Second
+
+// The connections to the peers, the timeout bounds the dial and the headers
+// but not the body of a big blob
+func newPeerTransport(timeout time.Duration) *http.Transport {
+	return &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: timeout}).DialContext,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       90 * time.Second,
+	}
+}
+
+// Copies a blob from the first peer having it to the local disk and marks it
+// AVAILABLE, returns its info as stored. The entry must be IN_PROGRESS; it
+// stays so if no peer has it and the caller must fetch it from the upstream.
+func (c *Cache) fetchFromPeers(shaname string, req *http.Request, ctx *goproxy.ProxyCtx) (blobInfo, bool) {
+	for _, peer := range c.cfg.Peers {
+		if info, ok := c.fetchFromPeer(peer, shaname, req, ctx); ok {
+			return info, true
+		}
+	}
+	return blobInfo{}, false
+}
+
+func (c *Cache) fetchFromPeer(peer string, shaname string, req *http.Request, ctx *goproxy.ProxyCtx) (blobInfo, bool) {
+	spanCtx, span := c.cfg.Tracer.Start(req.Context(), "peer-fetch",
+		trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String("peer", peer)))
+	defer span.End()
+	fetchCtx, cancel := spanCtx, context.CancelFunc(func() {})
+	if c.cfg.FetchTimeout > 0 {
+		fetchCtx, cancel = context.WithTimeout(spanCtx, c.cfg.FetchTimeout)
+	}
+	defer cancel()
+
+	host, digest := splitKey(shaname)
+	u := strings.TrimSuffix(peer, "/") + "/_cache/peer/blobs/sha256:" + digest
+	if host != "" {
+		u = strings.TrimSuffix(peer, "/") + "/_cache/peer/blobs/" + host + "/sha256:" + digest
+	}
+	preq, err := http.NewRequestWithContext(fetchCtx, "GET", u, nil)
+	if err != nil {
+		ctx.Warnf("Invalid peer %s: %s", peer, err)
+		return blobInfo{}, false
+	}
+	resp, err := c.peers.RoundTrip(preq)
+	if err != nil {
+		ctx.Logf("Peer %s unavailable: %s", peer, err)
+		span.SetStatus(codes.Error, err.Error())
+		return blobInfo{}, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		ctx.Logf("Peer %s does not have %s: %s", peer, shaname, resp.Status)
+		return blobInfo{}, false
+	}
+	if err := c.putVerified(shaname, resp.Body, resp.ContentLength); err != nil {
+		ctx.Warnf("Cannot fetch %s from peer %s: %s", shaname, peer, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return blobInfo{}, false
+	}
+	size, err := c.local.Stat(shaname)
+	if err != nil {
+		ctx.Warnf("Cannot fetch %s from peer %s: %s", shaname, peer, err)
+		return blobInfo{}, false
+	}
+	span.SetAttributes(attribute.Int64("bytes", size))
+
+	ctx.Logf("Fetched %s from peer %s", shaname, peer)
+	atomic.AddInt64(&c.stats.PeerHits, 1)
+	logEvent(ctx, "peer_hit", shaname, "MISS", "peer", peer)
+	return c.CompleteFetch(shaname, blobInfo{
+		size:          size,
+		diskSize:      size,
+		contentType:   resp.Header.Get("Content-Type"),
+		contentDigest: resp.Header.Get("Docker-Content-Digest"),
+		private:       hasCredentials(req),
+	}), true
+}
+
+// Serves a cached blob to a peer, never fetches it
+func (c *Cache) peerBlobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	shaname, ok := c.parseKey(strings.TrimPrefix(r.URL.Path, "/_cache/peer/blobs/"))
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "invalid digest")
+		return
+	}
+	// A download in progress is not waited for, the peer would time out
+	entry := c.acquire(shaname)
+	if entry == nil {
+		writeJSONError(w, http.StatusNotFound, "blob not in cache")
+		return
+	}
+	defer c.release(entry)
+	c.mu.Lock()
+	entry.atime = c.cfg.Clock.Now()
+	info := entry.blobInfo
+	c.mu.Unlock()
+	if info.private {
+		writeJSONError(w, http.StatusNotFound, "blob not in cache")
+		return
+	}
+	f, size, err := c.openBlob(shaname, info)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "blob not in cache")
+		return
+	}
+	defer f.Close()
+	contentType := info.contentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Docker-Content-Digest", "sha256:"+digestOf(shaname))
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if r.Method == "HEAD" {
+		return
+	}
+	io.Copy(w, &hitBody{f, nil, &c.stats.BytesServed, nil})
+}
@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// The modes of the cache directories and files are applied with an explicit
+// chmod: the umask of the process must not make them unreadable by the other
+// service accounts sharing the cache.
+
+const (
+	DefaultDirMode  = 0755
+	DefaultFileMode = 0644
+)
+
+// A permission flag written in octal, like 0750
+type ModeValue os.FileMode
+
+func (v *ModeValue) String() string {
+	return fmt.Sprintf("%#o", os.FileMode(*v))
+}
+
+func (v *ModeValue) Set(s string) error {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode&^uint64(os.ModePerm) != 0 {
+		return fmt.Errorf("invalid mode %q", s)
+	}
+	*v = ModeValue(mode)
+	return nil
+}
+
+// Creates dir and its missing parents with mode, not masked by the umask. The
+// downloads create their shard directory on demand: another one may create it
+// at the same time.
+func mkdirMode(dir string, mode os.FileMode) error {
+	if fi, err := os.Stat(dir); err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		return nil
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := mkdirMode(parent, mode); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, mode); err != nil {
+		if os.IsExist(err) {
+			return mkdirMode(dir, mode)
+		}
+		return err
+	}
+	return os.Chmod(dir, mode)
+}
+
+// Creates or truncates a file with mode
+func createMode(fname string, mode os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		os.Remove(fname)
+		return nil, err
+	}
+	return f, nil
+}
+
+// Creates the directory of a blob
+func (c *Cache) mkdirFor(fname string) error {
+	return mkdirMode(filepath.Dir(fname), c.cfg.DirMode)
+}
+
+// Fails fast if the cache directory cannot be written and read back
+func checkDirAccess(dir string) error {
+	f, err := ioutil.TempFile(dir, ".access-check")
+	if err != nil {
+		return fmt.Errorf("cache directory %s is not writable by uid %d: %s", dir, os.Getuid(), err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("ok")
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		_, err = ioutil.ReadFile(f.Name())
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write and read back a file in the cache directory %s: %s", dir, err)
+	}
+	return nil
+}
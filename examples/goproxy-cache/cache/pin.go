@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// A pinned blob is never evicted nor expired, whatever the pressure on the
+// cache: the base layers of an organization stay hits. The pins of
+// Config.Pinned are set at startup, those of the management endpoint are not
+// persisted. A digest can be pinned before it is cached. A pinned blob can
+// still be removed with DELETE /_cache/blobs/<digest>.
+
+// Pins the blobs of Config.Pinned, [host/]sha256:<hex> digests
+func (c *Cache) pinAll(digests []string) error {
+	c.pinned = make(map[string]bool)
+	for _, digest := range digests {
+		shaname, ok := c.parseKey(digest)
+		if !ok {
+			return fmt.Errorf("invalid pinned digest %q", digest)
+		}
+		c.pinned[shaname] = true
+	}
+	return nil
+}
+
+// c.mu must be held.
+func (c *Cache) isPinned(shaname string) bool {
+	return c.pinned[shaname]
+}
+
+// POST /_cache/pin/[<host>/]<digest> pins a blob, DELETE unpins it
+func (c *Cache) pinHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	digest := strings.TrimPrefix(r.URL.Path, "/_cache/pin/")
+	shaname, ok := c.parseKey(digest)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "invalid digest "+digest)
+		return
+	}
+
+	pin := r.Method == "POST"
+	c.mu.Lock()
+	if pin {
+		c.pinned[shaname] = true
+	} else {
+		delete(c.pinned, shaname)
+	}
+	c.mu.Unlock()
+	host, hex := splitKey(shaname)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"host": host, "digest": "sha256:" + hex, "pinned": pin})
+}
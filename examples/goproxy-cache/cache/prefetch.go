@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// With Config.PrefetchLayers, the blobs of an image manifest which are not
+// cached are pulled in the background when the manifest goes through the
+// proxy, so that the GETs of the client which follow are hits or join the
+// downloads. A prefetch is sent to the proxy handlers like the GET of a
+// client: it takes a fetch slot and gets the retries and the verification of
+// any other download. It needs the proxy of RegisterCache.
+//
+// The blobs are prefetched one after the other, with the credentials of the
+// manifest request. Indexes are not followed: the client picks one platform.
+
+type imageManifest struct {
+	Config manifestBlob
+	Layers []manifestBlob
+}
+
+// Starts the prefetch of the blobs of the manifest key, body is its content
+func (c *Cache) prefetchLayers(key string, body []byte, req *http.Request) {
+	if !c.cfg.PrefetchLayers || c.proxy == nil {
+		return
+	}
+	var manifest imageManifest
+	if err := json.Unmarshal(body, &manifest); err != nil || len(manifest.Layers) == 0 {
+		return
+	}
+
+	name := key[:strings.LastIndex(key, "@")]
+	var urls []string
+	for _, blob := range append(manifest.Layers, manifest.Config) {
+		shaname := strings.TrimPrefix(blob.Digest, "sha256:")
+		if !blobNameRe.MatchString(shaname) || !c.mediaTypeCached(blob.MediaType) {
+			continue
+		}
+		c.mu.RLock()
+		entry := c.entries[c.blobKey(req.URL.Host, shaname)]
+		c.mu.RUnlock()
+		if entry == nil || entry.status == EMPTY {
+			urls = append(urls, req.URL.Scheme+"://"+req.URL.Host+"/v2/"+name+"/blobs/sha256:"+shaname)
+		}
+	}
+	if len(urls) == 0 {
+		return
+	}
+	auth := req.Header.Get("Authorization")
+	go func() {
+		for _, u := range urls {
+			c.prefetch(u, auth)
+		}
+	}()
+}
+
+func (c *Cache) prefetch(u string, auth string) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		fmt.Printf("Cannot prefetch %s: %s\n", u, err)
+		return
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	fmt.Printf("prefetch: %s\n", u)
+	w := &discardResponse{header: make(http.Header)}
+	c.proxy.ServeHTTP(w, req)
+	if w.status != http.StatusOK {
+		fmt.Printf("Prefetch of %s returned %d\n", u, w.status)
+	}
+}
+
+// The ResponseWriter of a prefetch, the body was stored by the cache
+type discardResponse struct {
+	header http.Header
+	status int
+}
+
+func (w *discardResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponse) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *discardResponse) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(p), nil
+}
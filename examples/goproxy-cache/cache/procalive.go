@@ -0,0 +1,11 @@
+//go:build !windows
+
+package cache
+
+import "syscall"
+
+// Returns false if no process has this pid
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,1896 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// A tiny registry serving a single blob, it counts the requests it gets
+type fakeRegistry struct {
+	*httptest.Server
+	blob     []byte
+	digest   string
+	requests int64
+	failures int64  // the first requests fail with a 503
+	chunked  bool   // the blob is sent without a Content-Length
+	token    string // if set, the blob needs a Bearer token from /token
+}
+
+func newFakeRegistry(t *testing.T, blob []byte) *fakeRegistry {
+	sum := sha256.Sum256(blob)
+	reg := &fakeRegistry{blob: blob, digest: hex.EncodeToString(sum[:])}
+	reg.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&reg.requests, 1)
+		if reg.token != "" && r.URL.Path == "/token" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"token":"` + reg.token + `"}`))
+			return
+		}
+		if reg.token != "" && r.Header.Get("Authorization") != "Bearer "+reg.token {
+			scheme := "http"
+			if r.TLS != nil {
+				scheme = "https"
+			}
+			w.Header().Set("Www-Authenticate", `Bearer realm="`+scheme+`://`+r.Host+`/token",service="test"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/":
+			w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+			w.Write([]byte("{}"))
+			return
+		case "/v2/_catalog":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"repositories":["library/test"]}`))
+			return
+		}
+		if atomic.AddInt64(&reg.failures, -1) >= 0 {
+			http.Error(w, "try again later", http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path != reg.blobPath() {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Docker-Content-Digest", "sha256:"+reg.digest)
+		if reg.chunked {
+			w.(http.Flusher).Flush()
+		}
+		w.Write(reg.blob)
+	}))
+	t.Cleanup(reg.Close)
+	return reg
+}
+
+func (reg *fakeRegistry) blobPath() string {
+	return "/v2/library/test/blobs/sha256:" + reg.digest
+}
+
+func (reg *fakeRegistry) count() int64 {
+	return atomic.LoadInt64(&reg.requests)
+}
+
+// Starts a caching proxy in front of the upstreams, returns a client using it.
+// The proxy intercepts every CONNECT, the client trusts its CA.
+func newTestProxy(t *testing.T, cfg Config, setup ...func(*goproxy.ProxyHttpServer)) (*Cache, *http.Client) {
+	if cfg.Dir == "" {
+		cfg.Dir = t.TempDir()
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	for _, f := range setup {
+		f(proxy)
+	}
+	c, err := RegisterCache(proxy, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+
+	srv := httptest.NewServer(proxy)
+	t.Cleanup(srv.Close)
+	proxyURL, _ := url.Parse(srv.URL)
+	ca, err := x509.ParseCertificate(goproxy.GoproxyCa.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	return c, &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+}
+
+func pull(t *testing.T, client *http.Client, url string) []byte {
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("GET %s: %s", url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestPullIsCached(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	c, client := newTestProxy(t, Config{})
+
+	if body := pull(t, client, reg.URL+reg.blobPath()); !bytes.Equal(body, reg.blob) {
+		t.Fatalf("first pull returned %q", body)
+	}
+	if n := reg.count(); n != 1 {
+		t.Fatalf("upstream got %d requests, expected 1", n)
+	}
+
+	// The second pull waits for the first download to be stored if needed
+	if body := pull(t, client, reg.URL+reg.blobPath()); !bytes.Equal(body, reg.blob) {
+		t.Fatalf("second pull returned %q", body)
+	}
+	if n := reg.count(); n != 1 {
+		t.Fatalf("second pull was not served from the cache: upstream got %d requests", n)
+	}
+
+	stored, err := ioutil.ReadFile(c.blobPath(reg.digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, reg.blob) {
+		t.Fatalf("cached file contains %q", stored)
+	}
+	if hits := c.stats.snapshot().Hits; hits != 1 {
+		t.Errorf("expected 1 hit, got %d", hits)
+	}
+}
+
+func TestCorruptBlobIsNotCached(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	reg.digest = "0000000000000000000000000000000000000000000000000000000000000000"
+	c, client := newTestProxy(t, Config{})
+
+	pull(t, client, reg.URL+reg.blobPath())
+	pull(t, client, reg.URL+reg.blobPath())
+	if n := reg.count(); n != 2 {
+		t.Fatalf("blob with a wrong digest was served from the cache: upstream got %d requests", n)
+	}
+	if c.cacheExistsFor(reg.digest) {
+		t.Fatal("blob with a wrong digest was kept on disk")
+	}
+}
+
+func TestNoVerifyDigest(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	reg.digest = "0000000000000000000000000000000000000000000000000000000000000000"
+	c, client := newTestProxy(t, Config{NoVerifyDigest: true})
+
+	pull(t, client, reg.URL+reg.blobPath())
+	if _, ok, _ := c.Get(context.Background(), reg.digest); !ok {
+		t.Fatal("without digest verification the blob should be cached")
+	}
+}
+
+func TestCompressedPull(t *testing.T) {
+	reg := newFakeRegistry(t, bytes.Repeat([]byte("a layer of the test image\n"), 1000))
+	c, client := newTestProxy(t, Config{Compress: true})
+
+	pull(t, client, reg.URL+reg.blobPath())
+	if body := pull(t, client, reg.URL+reg.blobPath()); !bytes.Equal(body, reg.blob) {
+		t.Fatalf("cache hit returned %d bytes instead of the original blob", len(body))
+	}
+	if n := reg.count(); n != 1 {
+		t.Fatalf("upstream got %d requests, expected 1", n)
+	}
+
+	stored, err := ioutil.ReadFile(c.blobPath(reg.digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) >= len(reg.blob) {
+		t.Fatalf("blob not compressed on disk (%d bytes)", len(stored))
+	}
+
+	req, _ := http.NewRequest("GET", reg.URL+reg.blobPath(), nil)
+	req.Header.Set("Range", "bytes=100-")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, reg.blob[100:]) {
+		t.Fatalf("range of a compressed blob: %s, %d bytes", resp.Status, len(body))
+	}
+
+	// Without the index the compressed file is recognized when it is verified
+	reloaded, err := NewCache(Config{Dir: c.cfg.Dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry := reloaded.entries[reg.digest]; entry == nil || !entry.compressed || entry.size != int64(len(reg.blob)) {
+		t.Fatalf("compressed blob not reloaded: %+v", entry)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	c, _ := newTestProxy(t, Config{})
+	admin := httptest.NewServer(c.AdminHandler(false))
+	defer admin.Close()
+
+	for _, path := range []string{"/_cache/healthz", "/_cache/readyz"} {
+		resp, err := http.Get(admin.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Errorf("GET %s: %s", path, resp.Status)
+		}
+	}
+
+	c.cfg.ReadyCheckURL = reg.URL + "/v2/"
+	reg.Close()
+	resp, err := http.Get(admin.URL + "/_cache/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("readyz with the upstream down: %s", resp.Status)
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	defer func(backoff time.Duration) { fetchRetryBackoff = backoff }(fetchRetryBackoff)
+	fetchRetryBackoff = time.Millisecond
+
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	reg.failures = 2
+	c, client := newTestProxy(t, Config{FetchRetries: 2})
+
+	if body := pull(t, client, reg.URL+reg.blobPath()); !bytes.Equal(body, reg.blob) {
+		t.Fatalf("pull after retries returned %q", body)
+	}
+	if n := reg.count(); n != 3 {
+		t.Fatalf("upstream got %d requests, expected 3", n)
+	}
+	if _, ok, _ := c.Get(context.Background(), reg.digest); !ok {
+		t.Fatal("blob not cached after retries")
+	}
+
+	reg.failures = 3
+	resp, err := client.Get(reg.URL + "/v2/library/test/blobs/sha256:" + testBlob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected the last 503 once the retries are exhausted, got %s", resp.Status)
+	}
+}
+
+func TestNoCache(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	c, client := newTestProxy(t, Config{NoCache: true})
+
+	for i := 0; i < 2; i++ {
+		if body := pull(t, client, reg.URL+reg.blobPath()); !bytes.Equal(body, reg.blob) {
+			t.Fatalf("pull %d returned %q", i, body)
+		}
+	}
+	if n := reg.count(); n != 2 {
+		t.Fatalf("upstream got %d requests, expected 2", n)
+	}
+	if c.cacheExistsFor(reg.digest) {
+		t.Fatal("blob stored with caching disabled")
+	}
+}
+
+func TestHitWithoutMetadataHasDigest(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	dir := t.TempDir()
+	// A blob stored before the metadata were kept
+	if err := (localStore{dir: dir + "/"}).Put(reg.digest, bytes.NewReader(reg.blob), int64(len(reg.blob))); err != nil {
+		t.Fatal(err)
+	}
+	_, client := newTestProxy(t, Config{Dir: dir})
+
+	resp, err := client.Get(reg.URL + reg.blobPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if n := reg.count(); n != 0 {
+		t.Fatalf("upstream got %d requests, expected a cache hit", n)
+	}
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "sha256:"+reg.digest {
+		t.Fatalf("hit returned Docker-Content-Digest %q", digest)
+	}
+}
+
+func TestParentProxy(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	reg.Server.Close()
+	reg.Server = httptest.NewTLSServer(reg.Config.Handler)
+	defer reg.Server.Close()
+
+	var connects int64
+	parent := goproxy.NewProxyHttpServer()
+	parent.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		atomic.AddInt64(&connects, 1)
+		return goproxy.OkConnect, host
+	})
+	parentSrv := httptest.NewServer(parent)
+	defer parentSrv.Close()
+
+	c, client := newTestProxy(t, Config{}, func(proxy *goproxy.ProxyHttpServer) {
+		if err := SetParentProxy(proxy, parentSrv.URL); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// The client pulls through the MITM, the cache fetches through the parent
+	if body := pull(t, client, reg.URL+reg.blobPath()); !bytes.Equal(body, reg.blob) {
+		t.Fatalf("pull returned %q", body)
+	}
+	if n := atomic.LoadInt64(&connects); n != 1 {
+		t.Fatalf("parent proxy got %d CONNECT, expected 1", n)
+	}
+	// The pull may return before the proxy closes the upstream body
+	if _, ok, _ := c.Get(context.Background(), reg.digest); !ok {
+		t.Fatal("blob fetched through the parent proxy not cached")
+	}
+}
+
+func TestWaitForLockOfAnotherProcess(t *testing.T) {
+	defer func(period time.Duration) { lockPollPeriod = period }(lockPollPeriod)
+	lockPollPeriod = 10 * time.Millisecond
+
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	c, client := newTestProxy(t, Config{})
+	// Another instance sharing the directory is downloading the blob
+	os.MkdirAll(filepath.Dir(c.lockPath(reg.digest)), 0755)
+	if err := ioutil.WriteFile(c.lockPath(reg.digest), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ioutil.WriteFile(c.blobPath(reg.digest), reg.blob, 0644)
+		os.Remove(c.lockPath(reg.digest))
+	}()
+
+	if body := pull(t, client, reg.URL+reg.blobPath()); !bytes.Equal(body, reg.blob) {
+		t.Fatalf("pull returned %q", body)
+	}
+	if n := reg.count(); n != 0 {
+		t.Fatalf("upstream got %d requests, the blob of the other process was expected", n)
+	}
+}
+
+func TestWaitForLockWithoutFetchSlot(t *testing.T) {
+	locked := newFakeRegistry(t, []byte("a layer downloaded by another process"))
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	c, client := newTestProxy(t, Config{MaxConcurrentFetches: 1})
+	os.MkdirAll(filepath.Dir(c.lockPath(locked.digest)), 0755)
+	if err := ioutil.WriteFile(c.lockPath(locked.digest), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(c.lockPath(locked.digest))
+
+	// The client gives up while the other process still holds the lock
+	impatient := *client
+	impatient.Timeout = 100 * time.Millisecond
+	if resp, err := impatient.Get(locked.URL + locked.blobPath()); err == nil {
+		resp.Body.Close()
+		t.Fatalf("expected a timeout, got %s", resp.Status)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := locked.count(); n != 0 {
+		t.Fatalf("a cancelled request must not fetch, the upstream got %d requests", n)
+	}
+
+	// A waiter for the lock does not hold the only fetch slot
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", locked.URL+locked.blobPath(), nil)
+	go func() {
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	done := make(chan []byte)
+	go func() { done <- pull(t, client, reg.URL+reg.blobPath()) }()
+	select {
+	case body := <-done:
+		if !bytes.Equal(body, reg.blob) {
+			t.Fatalf("pull returned %q", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the fetch slot is held by the waiter of the lock")
+	}
+}
+
+func TestStaleLockIsTakenOver(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	c, client := newTestProxy(t, Config{})
+	os.MkdirAll(filepath.Dir(c.lockPath(reg.digest)), 0755)
+	if err := ioutil.WriteFile(c.lockPath(reg.digest), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * lockStaleAfter)
+	os.Chtimes(c.lockPath(reg.digest), old, old)
+
+	pull(t, client, reg.URL+reg.blobPath())
+	pull(t, client, reg.URL+reg.blobPath())
+	if n := reg.count(); n != 1 {
+		t.Fatalf("upstream got %d requests, expected 1", n)
+	}
+	if _, err := os.Stat(c.lockPath(reg.digest)); !os.IsNotExist(err) {
+		t.Fatalf("lock not removed after the download: %v", err)
+	}
+}
+
+func TestDeadLockIsTakenOver(t *testing.T) {
+	host, _ := os.Hostname()
+	// A dead process, and the previous run of a process with the same pid
+	for _, owner := range []string{fmt.Sprintf("999999999 %s 1", host), fmt.Sprintf("%d %s 1", os.Getpid(), host)} {
+		reg := newFakeRegistry(t, []byte("a layer of the test image"))
+		c, client := newTestProxy(t, Config{})
+		os.MkdirAll(filepath.Dir(c.lockPath(reg.digest)), 0755)
+		if err := ioutil.WriteFile(c.lockPath(reg.digest), []byte(owner+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		req, _ := http.NewRequestWithContext(ctx, "GET", reg.URL+reg.blobPath(), nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("lock of %q: %v", owner, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		cancel()
+		if !bytes.Equal(body, reg.blob) || reg.count() != 1 {
+			t.Fatalf("lock of %q: %d bytes, %d upstream requests", owner, len(body), reg.count())
+		}
+	}
+}
+
+func TestFileModes(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	c, client := newTestProxy(t, Config{DirMode: 0750, FileMode: 0640})
+	pull(t, client, reg.URL+reg.blobPath())
+	pull(t, client, reg.URL+reg.blobPath())
+
+	for fname, mode := range map[string]os.FileMode{
+		filepath.Dir(c.blobPath(reg.digest)): 0750,
+		c.blobPath(reg.digest):               0640,
+	} {
+		fi, err := os.Stat(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != mode {
+			t.Errorf("%s has mode %s, expected %s", fname, fi.Mode().Perm(), mode)
+		}
+	}
+}
+
+func TestPartialDownloadIsRemoved(t *testing.T) {
+	dir := t.TempDir() + "/"
+	tmp := tempPath(shardPath(dir, testBlob))
+	os.MkdirAll(filepath.Dir(tmp), 0755)
+	if err := ioutil.WriteFile(tmp, []byte("a partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestCacheIn(t, dir)
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatalf("partial download not removed: %v", err)
+	}
+	if c.cacheExistsFor(testBlob) {
+		t.Fatal("partial download loaded as a blob")
+	}
+}
+
+func TestTokenChallenge(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of a private image"))
+	reg.token = "secret"
+	c, client := newTestProxy(t, Config{})
+	get := func(url, token string) *http.Response {
+		req, _ := http.NewRequest("GET", url, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// 401 -> token -> 200, like the docker daemon does
+	resp := get(reg.URL+reg.blobPath(), "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("Www-Authenticate") == "" {
+		t.Fatalf("expected the upstream challenge, got %s %v", resp.Status, resp.Header)
+	}
+	resp = get(reg.URL+"/token", "")
+	token, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Contains(token, []byte("secret")) {
+		t.Fatalf("token request returned %q", token)
+	}
+	resp = get(reg.URL+reg.blobPath(), "secret")
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || !bytes.Equal(body, reg.blob) {
+		t.Fatalf("authenticated pull: %s %q", resp.Status, body)
+	}
+	if _, ok, _ := c.Get(context.Background(), reg.digest); !ok {
+		t.Fatal("authenticated pull not cached")
+	}
+
+	// Another authenticated client gets the cached blob
+	n := reg.count()
+	resp = get(reg.URL+reg.blobPath(), "another")
+	resp.Body.Close()
+	if resp.StatusCode != 200 || reg.count() != n {
+		t.Fatalf("authenticated client not served from the cache: %s, %d upstream requests", resp.Status, reg.count()-n)
+	}
+
+	// A client without credentials still gets the challenge
+	resp = get(reg.URL+reg.blobPath(), "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("private blob served without credentials: %s", resp.Status)
+	}
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	_, client := newTestProxy(t, Config{})
+	u := reg.URL + reg.blobPath()
+	pull(t, client, u)
+
+	for etag, status := range map[string]int{
+		`"sha256:` + reg.digest + `"`:              http.StatusNotModified,
+		`"sha256:` + strings.Repeat("0", 64) + `"`: http.StatusOK,
+	} {
+		req, _ := http.NewRequest("GET", u, nil)
+		req.Header.Set("If-None-Match", etag)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("If-None-Match %s: expected %d, got %s", etag, status, resp.Status)
+		}
+		if status == http.StatusNotModified && len(body) != 0 {
+			t.Fatalf("a 304 should have no body, got %q", body)
+		}
+	}
+	if n := reg.count(); n != 1 {
+		t.Fatalf("expected 1 upstream request, got %d", n)
+	}
+}
+
+func TestLoginAndPull(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of a private image"))
+	reg.token = "secret"
+	upstream := httptest.NewTLSServer(reg.Config.Handler)
+	defer upstream.Close()
+	c, client := newTestProxy(t, Config{CatalogTTL: time.Minute})
+	get := func(method, url, token string) *http.Response {
+		req, _ := http.NewRequest(method, url, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// docker login: the API version check is challenged, then accepted with a token
+	resp := get("GET", upstream.URL+"/v2/", "")
+	realm := resp.Header.Get("Www-Authenticate")
+	if resp.StatusCode != http.StatusUnauthorized || !strings.Contains(realm, upstream.URL+"/token") {
+		t.Fatalf("expected the challenge of the upstream, got %s %q", resp.Status, realm)
+	}
+	if resp := get("GET", upstream.URL+"/token", ""); resp.StatusCode != 200 {
+		t.Fatalf("token request: %s", resp.Status)
+	}
+	for _, method := range []string{"HEAD", "GET"} {
+		resp := get(method, upstream.URL+"/v2/", "secret")
+		if resp.StatusCode != 200 || resp.Header.Get("Docker-Distribution-Api-Version") != "registry/2.0" {
+			t.Fatalf("%s /v2/: %s %v", method, resp.Status, resp.Header)
+		}
+	}
+
+	// The catalog is asked once
+	n := reg.count()
+	for i := 0; i < 2; i++ {
+		if resp := get("GET", upstream.URL+"/v2/_catalog", "secret"); resp.StatusCode != 200 {
+			t.Fatalf("catalog: %s", resp.Status)
+		}
+	}
+	if reg.count() != n+1 {
+		t.Fatalf("the catalog should be cached, the upstream got %d requests", reg.count()-n)
+	}
+
+	if resp := get("GET", upstream.URL+reg.blobPath(), "secret"); resp.StatusCode != 200 {
+		t.Fatalf("pull: %s", resp.Status)
+	}
+	if _, ok, _ := c.Get(context.Background(), reg.digest); !ok {
+		t.Fatal("blob not cached")
+	}
+}
+
+// A HEAD in a MITM'd tunnel gets no body, not even the last chunk, so that the
+// next request on the connection gets its own response
+func TestMITMHeadKeepsTheConnection(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer"))
+	upstream := httptest.NewTLSServer(reg.Config.Handler)
+	defer upstream.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	if _, err := RegisterCache(proxy, Config{Dir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	host := strings.TrimPrefix(upstream.URL, "https://")
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+	br := bufio.NewReader(conn)
+	if resp, err := http.ReadResponse(br, nil); err != nil || resp.StatusCode != 200 {
+		t.Fatalf("CONNECT: %v %v", resp, err)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	tbr := bufio.NewReader(tlsConn)
+	for _, method := range []string{"HEAD", "GET"} {
+		req, _ := http.NewRequest(method, "https://"+host+"/v2/", nil)
+		if err := req.Write(tlsConn); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(tbr, req)
+		if err != nil {
+			t.Fatalf("%s /v2/: %s", method, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || method == "GET" && string(body) != "{}" {
+			t.Fatalf("%s /v2/: %s %q", method, resp.Status, body)
+		}
+	}
+}
+
+func TestNamespaceByHost(t *testing.T) {
+	blob := []byte("a layer pushed to two registries")
+	reg1, reg2 := newFakeRegistry(t, blob), newFakeRegistry(t, blob)
+	dir := t.TempDir()
+	c, client := newTestProxy(t, Config{Dir: dir, NamespaceByHost: true})
+
+	for _, reg := range []*fakeRegistry{reg1, reg2} {
+		pull(t, client, reg.URL+reg.blobPath())
+		u, _ := url.Parse(reg.URL)
+		if _, ok, _ := c.Get(context.Background(), c.blobKey(u.Host, reg.digest)); !ok {
+			t.Fatalf("blob of %s not cached", u.Host)
+		}
+	}
+	if n1, n2 := reg1.count(), reg2.count(); n1 != 1 || n2 != 1 {
+		t.Fatalf("each registry should be fetched once, got %d and %d requests", n1, n2)
+	}
+
+	// Both copies are found again after a restart
+	c = newTestCacheIn(t, dir)
+	if n := len(c.entries); n != 2 {
+		t.Fatalf("expected 2 entries after reload, got %d", n)
+	}
+}
+
+func TestNamespacedFetchesDoNotWait(t *testing.T) {
+	blob := []byte("a layer pushed to two registries")
+	reg1, reg2 := newFakeRegistry(t, blob), newFakeRegistry(t, blob)
+	c, client := newTestProxy(t, Config{NamespaceByHost: true})
+	u1, _ := url.Parse(reg1.URL)
+	u2, _ := url.Parse(reg2.URL)
+
+	// A download of the digest from the first registry never ends
+	if !c.BeginFetch(c.blobKey(u1.Host, reg1.digest)) {
+		t.Fatal("the blob should be EMPTY")
+	}
+	client.Timeout = 5 * time.Second
+	pull(t, client, reg2.URL+reg2.blobPath())
+	if _, ok, _ := c.Get(context.Background(), c.blobKey(u2.Host, reg2.digest)); !ok {
+		t.Fatal("the blob of the second registry should be cached")
+	}
+	c.mu.Lock()
+	status := c.getEntry(c.blobKey(u1.Host, reg1.digest)).status
+	c.mu.Unlock()
+	if status != IN_PROGRESS {
+		t.Fatalf("the download from the first registry should still be in progress, got status %d", status)
+	}
+}
+
+func TestFetchTimeoutResetsEntry(t *testing.T) {
+	blob := []byte("a layer sent by a stuck upstream")
+	sum := sha256.Sum256(blob)
+	digest := hex.EncodeToString(sum[:])
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+		w.Write(blob[:10])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+	c, client := newTestProxy(t, Config{FetchTimeout: 200 * time.Millisecond})
+
+	resp, err := client.Get(upstream.URL + "/v2/library/test/blobs/sha256:" + digest)
+	if err == nil {
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !c.BeginFetch(digest) {
+		if time.Now().After(deadline) {
+			t.Fatal("the entry of the timed out fetch was not reset")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWriteBufferPull(t *testing.T) {
+	reg := newFakeRegistry(t, bytes.Repeat([]byte("a layer written in the background\n"), 10000))
+	c, client := newTestProxy(t, Config{WriteBuffer: 64 * 1024})
+
+	if body := pull(t, client, reg.URL+reg.blobPath()); !bytes.Equal(body, reg.blob) {
+		t.Fatalf("pull returned %d bytes", len(body))
+	}
+	if _, ok, _ := c.Get(context.Background(), reg.digest); !ok {
+		t.Fatal("blob not cached")
+	}
+	stored, err := ioutil.ReadFile(c.blobPath(reg.digest))
+	if err != nil || !bytes.Equal(stored, reg.blob) {
+		t.Fatalf("blob not fully written before being AVAILABLE: %d bytes, %v", len(stored), err)
+	}
+}
+
+func TestHTTP2Upstream(t *testing.T) {
+	blob := []byte("a layer pulled over HTTP/2")
+	sum := sha256.Sum256(blob)
+	digest := hex.EncodeToString(sum[:])
+	var proto int64
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.StoreInt64(&proto, int64(r.ProtoMajor))
+		w.Write(blob)
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	// The pull goes through a MITM'd tunnel
+	c, client := newTestProxy(t, Config{}, func(proxy *goproxy.ProxyHttpServer) {
+		proxy.Tr.ForceAttemptHTTP2 = true
+	})
+	if body := pull(t, client, upstream.URL+"/v2/library/test/blobs/sha256:"+digest); !bytes.Equal(body, blob) {
+		t.Fatalf("pull returned %q", body)
+	}
+	if p := atomic.LoadInt64(&proto); p != 2 {
+		t.Fatalf("upstream spoken to in HTTP/%d", p)
+	}
+	if _, ok, _ := c.Get(context.Background(), digest); !ok {
+		t.Fatal("blob not cached")
+	}
+}
+
+func TestVanishedBlobIsFetchedAgain(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer removed behind the back of the cache"))
+	c, client := newTestProxy(t, Config{})
+
+	pull(t, client, reg.URL+reg.blobPath())
+	if _, ok, _ := c.Get(context.Background(), reg.digest); !ok {
+		t.Fatal("blob not cached")
+	}
+	os.Remove(c.blobPath(reg.digest))
+
+	if body := pull(t, client, reg.URL+reg.blobPath()); !bytes.Equal(body, reg.blob) {
+		t.Fatalf("pull of a vanished blob returned %q", body)
+	}
+	if n := reg.count(); n != 2 {
+		t.Fatalf("upstream got %d requests, expected 2", n)
+	}
+	if _, ok, _ := c.Get(context.Background(), reg.digest); !ok {
+		t.Fatal("vanished blob not cached again")
+	}
+}
+
+func TestTruncatedBlobIsFetchedAgain(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer truncated by a crash"))
+	c, client := newTestProxy(t, Config{})
+
+	pull(t, client, reg.URL+reg.blobPath())
+	if err := os.Truncate(c.blobPath(reg.digest), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if body := pull(t, client, reg.URL+reg.blobPath()); !bytes.Equal(body, reg.blob) {
+		t.Fatalf("pull of a truncated blob returned %q", body)
+	}
+	if n := reg.count(); n != 2 {
+		t.Fatalf("upstream got %d requests, expected 2", n)
+	}
+	if _, ok, _ := c.Get(context.Background(), reg.digest); !ok {
+		t.Fatal("truncated blob not cached again")
+	}
+	if fi, err := os.Stat(c.blobPath(reg.digest)); err != nil || fi.Size() != int64(len(reg.blob)) {
+		t.Fatal("the truncated file should be replaced by a new download")
+	}
+}
+
+func TestUnreachableUpstream(t *testing.T) {
+	defer func(backoff time.Duration) { fetchRetryBackoff = backoff }(fetchRetryBackoff)
+	fetchRetryBackoff = time.Millisecond
+
+	reg := newFakeRegistry(t, []byte("a layer of a registry which is down"))
+	c, client := newTestProxy(t, Config{FetchRetries: 1})
+	u := reg.URL
+	reg.Close()
+
+	resp, err := client.Get(u + reg.blobPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body map[string]string
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || body["digest"] != "sha256:"+reg.digest {
+		t.Fatalf("expected a 502 naming the digest, got %s %v", resp.Status, body)
+	}
+	if !c.BeginFetch(reg.digest) {
+		t.Fatal("the entry of the failed fetch should be EMPTY")
+	}
+}
+
+func TestDiskReserve(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer for a full disk"))
+	c, client := newTestProxy(t, Config{DiskReserve: 1 << 62})
+
+	if body := pull(t, client, reg.URL+reg.blobPath()); !bytes.Equal(body, reg.blob) {
+		t.Fatalf("pull returned %q", body)
+	}
+	if !c.BeginFetch(reg.digest) {
+		t.Fatal("a blob eating into the disk reserve should not be cached")
+	}
+}
+
+func TestServeStaleOnError(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2}`)
+	for _, revalidate := range []bool{false, true} {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Header().Set("Etag", `"v1"`)
+			w.Write(manifest)
+		}))
+		_, client := newTestProxy(t, Config{ManifestTTL: time.Millisecond, ManifestRevalidate: revalidate, ServeStaleOnError: true})
+		u := upstream.URL + "/v2/library/test/manifests/latest"
+		pull(t, client, u)
+		upstream.Close()
+		time.Sleep(10 * time.Millisecond)
+
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || !bytes.Equal(body, manifest) || resp.Header.Get("Warning") == "" {
+			t.Fatalf("revalidate=%v: expected the stale manifest, got %s %q", revalidate, resp.Status, body)
+		}
+	}
+}
+
+func TestNegativeTTL(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	c, client := newTestProxy(t, Config{NegativeTTL: 50 * time.Millisecond})
+	u := reg.URL + "/v2/library/test/blobs/sha256:" + strings.Repeat("0", 64)
+
+	get := func() int {
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for i := 0; i < 3; i++ {
+		if status := get(); status != http.StatusNotFound {
+			t.Fatalf("expected a 404, got %d", status)
+		}
+	}
+	if n := reg.count(); n != 1 {
+		t.Fatalf("expected 1 upstream request, got %d", n)
+	}
+	if c.available != 0 {
+		t.Fatalf("the 404 must not be cached as a blob")
+	}
+
+	// The 404 of an anonymous client is not served to an authenticated one
+	req, _ := http.NewRequest("GET", u, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if n := reg.count(); n != 2 {
+		t.Fatalf("expected the authenticated request to reach the upstream, got %d requests", n)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	get()
+	if n := reg.count(); n != 3 {
+		t.Fatalf("expected the upstream to be asked again after the TTL, got %d requests", n)
+	}
+}
+
+func TestFailureCooldown(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	reg.failures = 1
+	c, client := newTestProxy(t, Config{FailureCooldown: 50 * time.Millisecond})
+
+	resp, err := client.Get(reg.URL + reg.blobPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected the upstream 503, got %s", resp.Status)
+	}
+
+	// The upstream is fine again but the blob is only passed through
+	if body := pull(t, client, reg.URL+reg.blobPath()); !bytes.Equal(body, reg.blob) {
+		t.Fatalf("pull during the cooldown returned %q", body)
+	}
+	if _, ok, _ := c.Get(context.Background(), reg.digest); ok {
+		t.Fatal("blob cached during the cooldown")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	pull(t, client, reg.URL+reg.blobPath())
+	if _, ok, _ := c.Get(context.Background(), reg.digest); !ok {
+		t.Fatal("blob not cached after the cooldown")
+	}
+	if n := reg.count(); n != 3 {
+		t.Fatalf("expected 3 upstream requests, got %d", n)
+	}
+}
+
+func TestChunkedUpstream(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	reg.chunked = true
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"layers":[{"digest":"sha256:%s","size":%d}]}`, reg.digest, len(reg.blob)+1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Write([]byte(manifest))
+			return
+		}
+		reg.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+	c, client := newTestProxy(t, Config{NoVerifyDigest: true})
+
+	if body := pull(t, client, reg.URL+reg.blobPath()); !bytes.Equal(body, reg.blob) {
+		t.Fatalf("chunked pull returned %q", body)
+	}
+	info, ok, _ := c.Get(context.Background(), reg.digest)
+	if !ok || info.size != int64(len(reg.blob)) {
+		t.Fatalf("chunked blob not cached with its size: %v %+v", ok, info)
+	}
+	resp, err := client.Get(reg.URL + reg.blobPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ContentLength != int64(len(reg.blob)) {
+		t.Fatalf("hit sent a Content-Length of %d", resp.ContentLength)
+	}
+
+	// The manifest says the blob is one byte longer: the download is short
+	c, client = newTestProxy(t, Config{NoVerifyDigest: true})
+	pull(t, client, upstream.URL+"/v2/library/test/manifests/latest")
+	pull(t, client, upstream.URL+reg.blobPath())
+	if _, ok, _ := c.Get(context.Background(), reg.digest); ok {
+		t.Fatal("blob shorter than its manifest size cached")
+	}
+}
+
+func TestManifestPerRegistry(t *testing.T) {
+	registry := func(manifest string) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Write([]byte(manifest))
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	public := registry(`{"schemaVersion":2,"annotations":{"registry":"public"}}`)
+	private := registry(`{"schemaVersion":2,"annotations":{"registry":"private"}}`)
+	_, client := newTestProxy(t, Config{ManifestTTL: time.Minute})
+
+	// Same repository and tag on both registries
+	for _, s := range []*httptest.Server{public, private, public} {
+		name := "public"
+		if s == private {
+			name = "private"
+		}
+		if body := string(pull(t, client, s.URL+"/v2/library/alpine/manifests/3")); !strings.Contains(body, name) {
+			t.Fatalf("manifest of the %s registry: %s", name, body)
+		}
+	}
+}
+
+// A mount is forwarded even when the blob is cached: the registry must link
+// Run with -race: the revalidations replace the entry the other requests serve
+func TestConcurrentManifestRevalidation(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		w.Write([]byte(`{"schemaVersion":2}`))
+	}))
+	defer upstream.Close()
+	_, client := newTestProxy(t, Config{ManifestTTL: time.Millisecond, ManifestRevalidate: true})
+	u := upstream.URL + "/v2/library/test/manifests/latest"
+	pull(t, client, u)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				resp, err := client.Get(u)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode != 200 {
+					t.Errorf("manifest pull: %s", resp.Status)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPrivateManifestPerToken(t *testing.T) {
+	var requests int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		fmt.Fprintf(w, `{"schemaVersion":2,"annotations":{"for":%q}}`, r.Header.Get("Authorization"))
+	}))
+	defer upstream.Close()
+	_, client := newTestProxy(t, Config{ManifestTTL: time.Minute})
+	get := func(auth string) string {
+		req, _ := http.NewRequest("GET", upstream.URL+"/v2/private/app/manifests/1", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	for i, c := range []struct {
+		auth     string
+		requests int64
+	}{
+		{"Bearer a", 1},
+		{"Bearer a", 1},
+		{"Bearer b", 2},
+		{"", 3},
+	} {
+		if body := get(c.auth); !strings.Contains(body, fmt.Sprintf("%q", c.auth)) {
+			t.Fatalf("request %d with %q got the manifest %s", i, c.auth, body)
+		}
+		if n := atomic.LoadInt64(&requests); n != c.requests {
+			t.Fatalf("request %d with %q: upstream got %d requests, expected %d", i, c.auth, n, c.requests)
+		}
+	}
+}
+
+// the blob into the target repository
+func TestBlobMountIsForwarded(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	var mounts int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && r.URL.Query().Get("mount") == "sha256:"+reg.digest {
+			atomic.AddInt64(&mounts, 1)
+			w.Header().Set("Location", "/v2/library/other/blobs/sha256:"+reg.digest)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		reg.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+	c, client := newTestProxy(t, Config{})
+	pull(t, client, upstream.URL+reg.blobPath())
+	if _, ok, _ := c.Get(context.Background(), reg.digest); !ok {
+		t.Fatal("blob not cached")
+	}
+
+	resp, err := client.Post(upstream.URL+"/v2/library/other/blobs/uploads/?mount=sha256:"+reg.digest+"&from=library/test", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || atomic.LoadInt64(&mounts) != 1 {
+		t.Fatalf("mount of a cached blob: %s, %d mounts upstream", resp.Status, mounts)
+	}
+}
+
+func TestMinBlobSize(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	c, client := newTestProxy(t, Config{MinBlobSize: 1024})
+
+	for _, chunked := range []bool{false, true} {
+		reg.chunked = chunked
+		if body := pull(t, client, reg.URL+reg.blobPath()); !bytes.Equal(body, reg.blob) {
+			t.Fatalf("pull of a small blob returned %q", body)
+		}
+		if _, ok, _ := c.Get(context.Background(), reg.digest); ok {
+			t.Fatalf("blob smaller than MinBlobSize cached (chunked=%v)", chunked)
+		}
+	}
+}
+
+func TestRedirectToBlobStore(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			http.Error(w, "the URL is signed", http.StatusBadRequest)
+			return
+		}
+		reg.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer store.Close()
+	var redirects int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&redirects, 1)
+		http.Redirect(w, r, store.URL+r.URL.Path+"?signature=test", http.StatusTemporaryRedirect)
+	}))
+	defer upstream.Close()
+	c, client := newTestProxy(t, Config{})
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", upstream.URL+reg.blobPath(), nil)
+		req.Header.Set("Authorization", "Bearer registry-token")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(body, reg.blob) {
+			t.Fatalf("pull through the redirect returned %s %q", resp.Status, body)
+		}
+	}
+	if _, ok, _ := c.Get(context.Background(), reg.digest); !ok {
+		t.Fatal("redirected blob not cached")
+	}
+	if redirects != 1 || reg.count() != 1 {
+		t.Fatalf("expected 1 redirect and 1 download, got %d and %d", redirects, reg.count())
+	}
+}
+
+func TestMirrorPushes(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/blobs/uploads/") {
+			ioutil.ReadAll(r.Body)
+			if r.Method == "PUT" {
+				w.WriteHeader(http.StatusCreated)
+			} else {
+				w.WriteHeader(http.StatusAccepted)
+			}
+			return
+		}
+		reg.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+	c, client := newTestProxy(t, Config{MirrorPushes: true})
+
+	upload := upstream.URL + "/v2/library/test/blobs/uploads/0a1b2c"
+	half := len(reg.blob) / 2
+	for _, step := range []struct {
+		method string
+		u      string
+		chunk  []byte
+	}{
+		{"PATCH", upload, reg.blob[:half]},
+		{"PUT", upload + "?digest=sha256:" + reg.digest, reg.blob[half:]},
+	} {
+		req, _ := http.NewRequest(step.method, step.u, bytes.NewReader(step.chunk))
+		req.Header.Set("Authorization", "Bearer push-token")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if _, ok, _ := c.Get(context.Background(), reg.digest); !ok {
+		t.Fatal("pushed blob not cached")
+	}
+
+	req, _ := http.NewRequest("GET", upstream.URL+reg.blobPath(), nil)
+	req.Header.Set("Authorization", "Bearer pull-token")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(body, reg.blob) || reg.count() != 0 {
+		t.Fatalf("pull after the push returned %q with %d upstream requests", body, reg.count())
+	}
+}
+
+func TestCacheHeaders(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	c, client := newTestProxy(t, Config{HitHeaders: http.Header{"Cache-Control": {"max-age=60"}}})
+
+	get := func() *http.Response {
+		resp, err := client.Get(reg.URL + reg.blobPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	if resp := get(); resp.Header.Get("X-Cache") != "MISS" || resp.Header.Get("Cache-Control") != "" {
+		t.Fatalf("unexpected headers of a miss %v", resp.Header)
+	}
+	c.mu.Lock()
+	c.entries[reg.digest].stored = time.Now().Add(-time.Minute)
+	c.mu.Unlock()
+	resp := get()
+	if resp.Header.Get("X-Cache") != "HIT" || resp.Header.Get("Cache-Control") != "max-age=60" || resp.Header.Get("Age") != "60" {
+		t.Fatalf("unexpected headers of a hit %v", resp.Header)
+	}
+}
+
+func TestInlineBlobs(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	c, client := newTestProxy(t, Config{InlineBlobSize: 1024})
+
+	for i := 0; i < 2; i++ {
+		if body := pull(t, client, reg.URL+reg.blobPath()); !bytes.Equal(body, reg.blob) {
+			t.Fatalf("pull %d of an inline blob returned %q", i, body)
+		}
+	}
+	if n := reg.count(); n != 1 {
+		t.Fatalf("inline blob fetched %d times from upstream", n)
+	}
+	if _, err := os.Stat(c.blobPath(reg.digest)); !os.IsNotExist(err) {
+		t.Fatalf("file of an inline blob left on disk: %v", err)
+	}
+	if data, err := c.readInline(reg.digest); err != nil || !bytes.Equal(data, reg.blob) {
+		t.Fatalf("inline blob stored as %q: %v", data, err)
+	}
+
+	// Without the index the blob is found in the database
+	c.db.Close()
+	reloaded, err := NewCache(Config{Dir: c.cfg.Dir, InlineBlobSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.db.Close()
+	if entry := reloaded.entries[reg.digest]; entry == nil || !entry.inline || entry.size != int64(len(reg.blob)) {
+		t.Fatalf("inline blob not reloaded: %+v", entry)
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	reg := newFakeRegistry(t, bytes.Repeat([]byte("a layer of the test image"), 1000))
+	for _, newServer := range []func(http.Handler) *httptest.Server{httptest.NewServer, httptest.NewTLSServer} {
+		var requests int64
+		upstream := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt64(&requests, 1) > 1 {
+				reg.Config.Handler.ServeHTTP(w, r)
+				return
+			}
+			// Half of the blob, then nothing until the client gives up
+			w.Header().Set("Content-Length", fmt.Sprint(len(reg.blob)))
+			w.Write(reg.blob[:len(reg.blob)/2])
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}))
+		c, client := newTestProxy(t, Config{FailureCooldown: time.Minute})
+
+		resp, err := client.Get(upstream.URL + reg.blobPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(resp.Body, make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		// The fetch is aborted, not failed: the next pull downloads it again
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			c.mu.Lock()
+			status := c.entries[reg.digest].status
+			c.mu.Unlock()
+			if status == EMPTY {
+				break
+			}
+			if status == FAILED || time.Now().After(deadline) {
+				t.Fatalf("%s: entry is %d after the client went away", upstream.URL, status)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if _, err := os.Stat(tempPath(c.blobPath(reg.digest))); !os.IsNotExist(err) {
+			t.Fatalf("%s: partial file left: %v", upstream.URL, err)
+		}
+		if body := pull(t, client, upstream.URL+reg.blobPath()); !bytes.Equal(body, reg.blob) {
+			t.Fatalf("%s: pull after a cancel returned %d bytes", upstream.URL, len(body))
+		}
+		if _, ok, _ := c.Get(context.Background(), reg.digest); !ok {
+			t.Fatalf("%s: blob not cached after a cancel", upstream.URL)
+		}
+		upstream.Close()
+	}
+}
+
+func TestMirrorMap(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	var hosts, serverNames []string
+	var mu sync.Mutex
+	mirror := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hosts = append(hosts, r.Host)
+		serverNames = append(serverNames, r.TLS.ServerName)
+		mu.Unlock()
+		reg.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer mirror.Close()
+	c, client := newTestProxy(t, Config{MirrorMap: map[string]string{"registry.test": "mirror.test"}}, func(proxy *goproxy.ProxyHttpServer) {
+		proxy.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		proxy.Tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr != "mirror.test:443" {
+				return nil, fmt.Errorf("unexpected dial of %s", addr)
+			}
+			return net.Dial(network, mirror.Listener.Addr().String())
+		}
+	})
+
+	for i := 0; i < 2; i++ {
+		if body := pull(t, client, "https://registry.test"+reg.blobPath()); !bytes.Equal(body, reg.blob) {
+			t.Fatalf("pull %d through the mirror returned %q", i, body)
+		}
+	}
+	resp, err := client.Get("https://registry.test/v2/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if _, ok, _ := c.Get(context.Background(), reg.digest); !ok {
+		t.Fatal("blob from the mirror not cached")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(hosts) != 2 {
+		t.Fatalf("expected the blob and the API version check at the mirror, got %d requests", len(hosts))
+	}
+	for i := range hosts {
+		if hosts[i] != "mirror.test" || serverNames[i] != "mirror.test" {
+			t.Fatalf("mirror request with Host %q and SNI %q", hosts[i], serverNames[i])
+		}
+	}
+}
+
+func TestNoEvictionWhileServed(t *testing.T) {
+	// Bigger than the socket buffers: the hit is still being sent
+	reg := newFakeRegistry(t, bytes.Repeat([]byte("a layer of the test image"), 1<<20))
+	c, client := newTestProxy(t, Config{})
+	pull(t, client, reg.URL+reg.blobPath())
+
+	resp, err := client.Get(reg.URL + reg.blobPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.expire(0)
+	if _, ok, _ := c.Get(context.Background(), reg.digest); !ok {
+		t.Fatal("blob expired while it is served")
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(body, reg.blob) {
+		t.Fatalf("hit returned %d bytes", len(body))
+	}
+
+	// Released once the proxy closes the body
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.expire(0)
+		if _, ok, _ := c.Get(context.Background(), reg.digest); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("blob still held after the hit")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCompressedServedGzipped(t *testing.T) {
+	reg := newFakeRegistry(t, bytes.Repeat([]byte("a layer of the test image\n"), 1000))
+	_, client := newTestProxy(t, Config{Compress: true})
+	pull(t, client, reg.URL+reg.blobPath())
+
+	get := func(acceptEncoding string) (*http.Response, []byte) {
+		req, _ := http.NewRequest("GET", reg.URL+reg.blobPath(), nil)
+		// Set by hand, the transport does not decompress the body
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.Header.Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("no Vary header with Accept-Encoding %q", acceptEncoding)
+		}
+		return resp, body
+	}
+
+	resp, body := get("br, gzip")
+	if resp.Header.Get("Content-Encoding") != "gzip" || len(body) >= len(reg.blob) {
+		t.Fatalf("expected the gzipped blob, got %q and %d bytes", resp.Header.Get("Content-Encoding"), len(body))
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadAll(gz); !bytes.Equal(content, reg.blob) {
+		t.Fatalf("gzipped blob decompressed to %d bytes", len(content))
+	}
+
+	for _, acceptEncoding := range []string{"identity", "gzip;q=0"} {
+		resp, body := get(acceptEncoding)
+		if resp.Header.Get("Content-Encoding") != "" || !bytes.Equal(body, reg.blob) {
+			t.Fatalf("Accept-Encoding %q got %q and %d bytes", acceptEncoding, resp.Header.Get("Content-Encoding"), len(body))
+		}
+	}
+}
+
+func TestHeadBlob(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	c, client := newTestProxy(t, Config{FailureCooldown: time.Minute})
+
+	// Not cached: forwarded, without starting a download
+	head := func() *http.Response {
+		resp, err := client.Head(reg.URL + reg.blobPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || len(body) != 0 || resp.ContentLength != int64(len(reg.blob)) {
+			t.Fatalf("HEAD returned %s, Content-Length %d and %d bytes", resp.Status, resp.ContentLength, len(body))
+		}
+		return resp
+	}
+	if resp := head(); resp.Header.Get("X-Cache") != "MISS" {
+		t.Fatalf("HEAD of a blob not cached got X-Cache %q", resp.Header.Get("X-Cache"))
+	}
+	if n := reg.count(); n != 1 {
+		t.Fatalf("HEAD not forwarded: %d upstream requests", n)
+	}
+	pull(t, client, reg.URL+reg.blobPath())
+	if _, ok, _ := c.Get(context.Background(), reg.digest); !ok {
+		t.Fatal("blob not cached after a HEAD")
+	}
+
+	resp := head()
+	if resp.Header.Get("X-Cache") != "HIT" || resp.Header.Get("Docker-Content-Digest") != "sha256:"+reg.digest {
+		t.Fatalf("HEAD of a cached blob: %v", resp.Header)
+	}
+	if n := reg.count(); n != 2 {
+		t.Fatalf("HEAD of a cached blob forwarded: %d upstream requests", n)
+	}
+}
+
+func TestUnsatisfiableRange(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	c, client := newTestProxy(t, Config{})
+	pull(t, client, reg.URL+reg.blobPath())
+	hits := atomic.LoadInt64(&c.stats.Hits)
+
+	req, _ := http.NewRequest("GET", reg.URL+reg.blobPath(), nil)
+	req.Header.Set("Range", "bytes=1000-")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("range past the end: %s", resp.Status)
+	}
+	if n := atomic.LoadInt64(&c.stats.Hits); n != hits {
+		t.Fatalf("416 counted as a hit: %d hits", n)
+	}
+	c.mu.RLock()
+	readers := c.entries[reg.digest].readers
+	c.mu.RUnlock()
+	if readers != 0 {
+		t.Fatalf("%d readers left after the 416", readers)
+	}
+
+	if body := pull(t, client, reg.URL+reg.blobPath()); !bytes.Equal(body, reg.blob) {
+		t.Fatalf("hit after the 416 returned %d bytes", len(body))
+	}
+	if n := reg.count(); n != 1 {
+		t.Fatalf("upstream got %d requests, expected 1", n)
+	}
+}
+
+func TestReadDirs(t *testing.T) {
+	seeded := newFakeRegistry(t, []byte("a layer of the seed cache"))
+	corrupt := newFakeRegistry(t, []byte("a layer corrupted in the seed cache"))
+	seed := t.TempDir() + "/"
+	for shaname, data := range map[string]string{seeded.digest: string(seeded.blob), corrupt.digest: "garbage"} {
+		fname := shardPath(seed, shaname)
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fname, []byte(data), 0444); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, client := newTestProxy(t, Config{ReadDirs: []string{t.TempDir(), seed}})
+
+	if !c.cacheExistsFor(seeded.digest) {
+		t.Fatal("blob of the read-only directory not found")
+	}
+	for i := 0; i < 2; i++ {
+		if body := pull(t, client, seeded.URL+seeded.blobPath()); string(body) != string(seeded.blob) {
+			t.Fatalf("got %q", body)
+		}
+	}
+	if n := seeded.count(); n != 0 {
+		t.Fatalf("blob of the read-only directory fetched %d times from the upstream", n)
+	}
+	if _, err := os.Stat(c.blobPath(seeded.digest)); !os.IsNotExist(err) {
+		t.Fatalf("blob of the read-only directory copied: %v", err)
+	}
+
+	// A bad file is ignored, the download lands in the cache directory
+	if body := pull(t, client, corrupt.URL+corrupt.blobPath()); string(body) != string(corrupt.blob) {
+		t.Fatalf("got %q", body)
+	}
+	if data, err := ioutil.ReadFile(c.blobPath(corrupt.digest)); err != nil || string(data) != string(corrupt.blob) {
+		t.Fatalf("download not stored in the cache directory: %q, %v", data, err)
+	}
+	if data, _ := ioutil.ReadFile(shardPath(seed, corrupt.digest)); string(data) != "garbage" {
+		t.Fatalf("read-only file overwritten: %q", data)
+	}
+
+	// Only the local blobs count, and only them are removed
+	c.mu.Lock()
+	if c.totalSize != int64(len(corrupt.blob)) || c.available != 1 {
+		t.Errorf("%d bytes in %d blobs", c.totalSize, c.available)
+	}
+	c.removeEntry(seeded.digest)
+	c.mu.Unlock()
+	if _, err := os.Stat(shardPath(seed, seeded.digest)); err != nil {
+		t.Fatalf("read-only file removed: %v", err)
+	}
+}
+
+func TestTraceSpans(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	spans := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("test")
+	_, client := newTestProxy(t, Config{Tracer: tracer})
+
+	const traceID, clientSpan = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", reg.URL+reg.blobPath(), nil)
+		req.Header.Set("traceparent", "00-"+traceID+"-"+clientSpan+"-01")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	// The request spans end once goproxy closes the bodies
+	names := map[string][]sdktrace.ReadOnlySpan{}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(names["GET "+reg.Listener.Addr().String()]) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("spans: %v", names)
+		}
+		time.Sleep(10 * time.Millisecond)
+		names = map[string][]sdktrace.ReadOnlySpan{}
+		for _, span := range spans.Ended() {
+			names[span.Name()] = append(names[span.Name()], span)
+		}
+	}
+	requests := names["GET "+reg.Listener.Addr().String()]
+	for _, span := range requests {
+		if span.SpanContext().TraceID().String() != traceID || span.Parent().SpanID().String() != clientSpan {
+			t.Errorf("request span not a child of the client span: %v", span.Parent())
+		}
+	}
+	if n := len(names["cache-lookup"]); n != 2 {
+		t.Errorf("%d cache-lookup spans", n)
+	}
+	for _, name := range []string{"upstream-fetch", "disk-write"} {
+		if len(names[name]) != 1 {
+			t.Fatalf("%d %s spans, want one for the miss", len(names[name]), name)
+		}
+		if parent := names[name][0].Parent().SpanID(); parent != requests[0].SpanContext().SpanID() && parent != requests[1].SpanContext().SpanID() {
+			t.Errorf("%s is not a child of a request span", name)
+		}
+	}
+}
+
+func TestSecondaryKeys(t *testing.T) {
+	seeded := newFakeRegistry(t, []byte("a layer of the secondary cache"))
+	late := newFakeRegistry(t, []byte("a layer uploaded by another node"))
+	store := localStore{dir: t.TempDir() + "/", dirMode: 0755, fileMode: 0644}
+	if err := store.Put(seeded.digest, bytes.NewReader(seeded.blob), int64(len(seeded.blob))); err != nil {
+		t.Fatal(err)
+	}
+	c, client := newTestProxy(t, Config{Secondary: store})
+	if !c.probablyInSecondary(seeded.digest) || c.probablyInSecondary(late.digest) {
+		t.Fatal("filter not built from the listing")
+	}
+
+	// Another node uploads a blob after the startup of c
+	_, other := newTestProxy(t, Config{Secondary: store})
+	pull(t, other, late.URL+late.blobPath())
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := store.Stat(late.digest); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("blob not uploaded by the other node")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pull(t, client, late.URL+late.blobPath())
+	if n := late.count(); n != 1 {
+		t.Fatalf("blob uploaded by another node fetched %d times from the upstream", n)
+	}
+	pull(t, client, seeded.URL+seeded.blobPath())
+	if n := seeded.count(); n != 0 {
+		t.Fatalf("blob of the secondary tier fetched %d times from the upstream", n)
+	}
+
+	// Known once the filter is rebuilt
+	c.loadSecondaryKeys()
+	if !c.probablyInSecondary(late.digest) {
+		t.Fatal("rebuilt filter misses the blob of the other node")
+	}
+
+	// A store which cannot list has no filter
+	c, err := NewCache(Config{Dir: t.TempDir(), Secondary: struct{ BlobStore }{store}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.secondaryKeys != nil || c.probablyInSecondary(testBlob) {
+		t.Fatal("filter built without a listing")
+	}
+}
+
+func TestSecondaryInlineBlob(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a small layer of the secondary cache"))
+	store := localStore{dir: t.TempDir() + "/", dirMode: 0755, fileMode: 0644}
+	if err := store.Put(reg.digest, bytes.NewReader(reg.blob), int64(len(reg.blob))); err != nil {
+		t.Fatal(err)
+	}
+	c, client := newTestProxy(t, Config{Secondary: store, InlineBlobSize: 1024})
+
+	if body := pull(t, client, reg.URL+reg.blobPath()); !bytes.Equal(body, reg.blob) {
+		t.Fatalf("pull returned %q", body)
+	}
+	if n := reg.count(); n != 0 {
+		t.Fatalf("blob of the secondary tier fetched %d times from the upstream", n)
+	}
+	if info, ok, _ := c.Get(context.Background(), reg.digest); !ok || !info.inline {
+		t.Fatalf("blob of the secondary tier not inline: %v %+v", ok, info)
+	}
+}
+
+func TestPrefetchLayers(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"sha256:%s"}]}`, reg.digest)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Write([]byte(manifest))
+			return
+		}
+		reg.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+	c, client := newTestProxy(t, Config{PrefetchLayers: true})
+
+	pull(t, client, upstream.URL+"/v2/library/test/manifests/latest")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok, _ := c.Get(context.Background(), reg.digest); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the layer was not prefetched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pull(t, client, upstream.URL+reg.blobPath())
+	if n := reg.count(); n != 1 {
+		t.Fatalf("expected the layer to be fetched once, got %d requests", n)
+	}
+}
+
+func TestPeers(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer shared by the fleet"))
+	other := newFakeRegistry(t, []byte("a layer only upstream"))
+	c1, client1 := newTestProxy(t, Config{})
+	pull(t, client1, reg.URL+reg.blobPath())
+	peer := httptest.NewServer(c1.AdminHandler(false))
+	defer peer.Close()
+
+	// The first peer is down, the second one has the blob
+	c2, client2 := newTestProxy(t, Config{Peers: []string{"http://127.0.0.1:1", peer.URL}})
+	if body := pull(t, client2, reg.URL+reg.blobPath()); !bytes.Equal(body, reg.blob) {
+		t.Fatalf("unexpected blob from the peer %q", body)
+	}
+	if n := reg.count(); n != 1 {
+		t.Fatalf("the blob should come from the peer, the upstream got %d requests", n)
+	}
+	if _, ok, _ := c2.Get(context.Background(), reg.digest); !ok {
+		t.Fatal("the blob of the peer should be cached")
+	}
+	if hits := c2.stats.snapshot().PeerHits; hits != 1 {
+		t.Fatalf("expected 1 peer hit, got %d", hits)
+	}
+
+	// No peer has this one
+	if body := pull(t, client2, other.URL+other.blobPath()); !bytes.Equal(body, other.blob) {
+		t.Fatalf("unexpected blob from the upstream %q", body)
+	}
+	if n := other.count(); n != 1 {
+		t.Fatalf("the upstream should be the fallback, got %d requests", n)
+	}
+}
+
+func TestBrokenPeer(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer broken by a peer"))
+	for name, answer := range map[string]func(w http.ResponseWriter){
+		"truncated": func(w http.ResponseWriter) {
+			w.Header().Set("Content-Length", strconv.Itoa(len(reg.blob)))
+			w.Write(reg.blob[:5])
+		},
+		"corrupt": func(w http.ResponseWriter) {
+			w.Write(bytes.ToUpper(reg.blob))
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { answer(w) }))
+			defer peer.Close()
+			before := reg.count()
+
+			c, client := newTestProxy(t, Config{Peers: []string{peer.URL}, FetchTimeout: time.Minute})
+			if body := pull(t, client, reg.URL+reg.blobPath()); !bytes.Equal(body, reg.blob) {
+				t.Fatalf("unexpected blob %q", body)
+			}
+			if n := reg.count() - before; n != 1 {
+				t.Fatalf("the upstream should be the fallback, got %d requests", n)
+			}
+			if _, ok, _ := c.Get(context.Background(), reg.digest); !ok {
+				t.Fatal("the blob of the upstream should be cached")
+			}
+			if hits := c.stats.snapshot().PeerHits; hits != 0 {
+				t.Fatalf("expected no peer hit, got %d", hits)
+			}
+		})
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	reg := newFakeRegistry(t, []byte("a layer of the test image"))
+	var log bytes.Buffer
+	var mu sync.Mutex
+	c, client := newTestProxy(t, Config{AccessLog: lockedWriter{&log, &mu}})
+
+	pull(t, client, reg.URL+reg.blobPath())
+	c.Get(context.Background(), reg.digest)
+	pull(t, client, reg.URL+reg.blobPath())
+
+	mu.Lock()
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	mu.Unlock()
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 access log lines, got %q", lines)
+	}
+	want := fmt.Sprintf("\"GET %s%s HTTP/1.1\" 200 %d", reg.URL, reg.blobPath(), len(reg.blob))
+	if !strings.Contains(lines[0], want) || !strings.HasSuffix(lines[0], " MISS") || !strings.HasSuffix(lines[1], " HIT") {
+		t.Fatalf("unexpected access log %q", lines)
+	}
+}
+
+type lockedWriter struct {
+	w  io.Writer
+	mu *sync.Mutex
+}
+
+func (w lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
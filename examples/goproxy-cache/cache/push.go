@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// With Config.MirrorPushes the blobs pushed through the proxy are cached, so
+// that the pulls which follow are hits. An upload is a series of requests on
+// /v2/<name>/blobs/uploads/<uuid>: PATCHes sending chunks, then a PUT naming
+// the digest, which may send the last chunk or the whole blob. Their bodies
+// are appended to <dir>/.uploads/<hash of the upload URL> and, once the
+// registry answers the PUT with a 201, the file is checked against the digest
+// and moved into the cache like a download.
+//
+// A chunk the registry rejects is left in the file: the digest check drops
+// such an upload. The files of the uploads never completed are removed at
+// startup.
+
+const uploadsDir = ".uploads"
+
+var uploadRe = regexp.MustCompile("^/v2/.+/blobs/uploads/[^/]+$")
+
+// Returns the file collecting an upload, or "" if req is not part of one
+func (c *Cache) uploadFile(req *http.Request) string {
+	switch req.Method {
+	case "PATCH", "PUT", "DELETE":
+	default:
+		return ""
+	}
+	if !uploadRe.MatchString(req.URL.Path) {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(req.URL.Host + req.URL.Path))
+	return c.dir + uploadsDir + "/" + hex.EncodeToString(sum[:])
+}
+
+// Appends the body of an upload request to fname while it is sent, a DELETE
+// cancelling the upload removes it
+func (c *Cache) captureUpload(fname string, req *http.Request, ctx *goproxy.ProxyCtx) {
+	if req.Method == "DELETE" {
+		os.Remove(fname)
+		return
+	}
+	if err := mkdirMode(c.dir+uploadsDir, c.cfg.DirMode); err != nil {
+		ctx.Warnf("Cannot create %s: %s", c.dir+uploadsDir, err)
+		return
+	}
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_APPEND, c.cfg.FileMode)
+	if err != nil {
+		ctx.Warnf("Cannot capture the upload %s: %s", req.URL.Path, err)
+		return
+	}
+	stateOf(ctx).upload = fname
+	if req.Body == nil || req.Body == http.NoBody {
+		f.Close()
+		return
+	}
+	req.Body = &uploadTee{req.Body, f, ctx}
+}
+
+// Moves a completed upload into the cache, drops the file of a failed one
+func (c *Cache) finishUpload(fname string, resp *http.Response, ctx *goproxy.ProxyCtx) {
+	req := resp.Request
+	if req.Method == "PATCH" && resp.StatusCode == http.StatusAccepted {
+		return
+	}
+	defer os.Remove(fname)
+	if req.Method != "PUT" || resp.StatusCode != http.StatusCreated {
+		ctx.Logf("Upload %s ended with %s", req.URL.Path, resp.Status)
+		return
+	}
+	shaname := strings.TrimPrefix(req.URL.Query().Get("digest"), "sha256:")
+	if !blobNameRe.MatchString(shaname) {
+		ctx.Logf("Upload %s has no sha256 digest, do not cache it", req.URL.Path)
+		return
+	}
+	key := c.blobKey(req.URL.Host, shaname)
+	info, err := verifyBlob(fname, shaname)
+	if err != nil {
+		ctx.Warnf("Pushed blob %s not cached: %s", key, err)
+		return
+	}
+	if max := c.cfg.MaxBlobSize; (max > 0 && info.size > max) || info.size < c.cfg.MinBlobSize {
+		ctx.Logf("Pushed blob %s has %d bytes, do not cache it", key, info.size)
+		return
+	}
+	if !c.BeginFetch(key) {
+		ctx.Logf("Pushed blob %s already cached or downloaded", key)
+		return
+	}
+	if err := c.storeUpload(fname, key); err != nil {
+		ctx.Warnf("Cannot store pushed blob %s: %s", key, err)
+		c.CancelFetch(key)
+		return
+	}
+	info.private = hasCredentials(req)
+	info.contentType = "application/octet-stream"
+	info.contentDigest = "sha256:" + shaname
+	ctx.Logf("Pushed blob %s stored in cache (%d bytes)", key, info.size)
+	logEvent(ctx, "push", key, "STORED", "bytes", info.size)
+	c.CompleteFetch(key, info)
+}
+
+func (c *Cache) storeUpload(fname string, key string) error {
+	path := c.blobPath(key)
+	if err := c.mkdirFor(path); err != nil {
+		return err
+	}
+	if err := os.Chmod(fname, c.cfg.FileMode); err != nil {
+		return err
+	}
+	return os.Rename(fname, path)
+}
+
+// Removes the files of the uploads left by a previous run
+func (c *Cache) removeUploads() {
+	files, err := ioutil.ReadDir(c.dir + uploadsDir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		fmt.Printf("Remove incomplete upload %s\n", file.Name())
+		os.Remove(c.dir + uploadsDir + "/" + file.Name())
+	}
+}
+
+// Copies the body of an upload request to its file while it is sent
+type uploadTee struct {
+	body io.ReadCloser
+	f    *os.File // nil once a write failed
+	ctx  *goproxy.ProxyCtx
+}
+
+func (u *uploadTee) Read(p []byte) (int, error) {
+	n, err := u.body.Read(p)
+	if n > 0 && u.f != nil {
+		if _, err := u.f.Write(p[:n]); err != nil {
+			// The digest check drops the upload
+			u.ctx.Warnf("Cannot capture the upload: %s", err)
+			u.f.Close()
+			u.f = nil
+		}
+	}
+	return n, err
+}
+
+func (u *uploadTee) Close() error {
+	if u.f != nil {
+		u.f.Close()
+		u.f = nil
+	}
+	return u.body.Close()
+}
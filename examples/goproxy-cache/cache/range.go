@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var errUnsatisfiableRange = errors.New("unsatisfiable range")
+
+// Parses a Range header against a blob of the given size.
+// Returns ok == false when the whole body should be served: no header,
+// a header we don't understand, or a multi-range request.
+func parseRange(header string, size int64) (start, length int64, ok bool, err error) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return 0, 0, false, nil
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	if strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	dash := strings.Index(spec, "-")
+	if dash < 0 {
+		return 0, 0, false, nil
+	}
+	first, last := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+
+	if first == "" {
+		// bytes=-N : the last N bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return 0, 0, false, nil
+		}
+		if n <= 0 || size == 0 {
+			return 0, 0, false, errUnsatisfiableRange
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true, nil
+	}
+
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+	if start >= size {
+		return 0, 0, false, errUnsatisfiableRange
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false, nil
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, true, nil
+}
+
+func contentRange(start, length, size int64) string {
+	return "bytes " + strconv.FormatInt(start, 10) + "-" + strconv.FormatInt(start+length-1, 10) + "/" + strconv.FormatInt(size, 10)
+}
+
+// Limits the read part of a file while still closing it
+type sectionReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,42 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// A token bucket of bytes shared by every cache hit, so that it bounds the
+// aggregate throughput of the disk and not that of each connection.
+type rateLimiter struct {
+	rate  float64 // bytes per second
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64 // negative when the readers owe bytes
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	burst := float64(bytesPerSecond) / 10
+	if burst < writeBehindChunk {
+		burst = writeBehindChunk
+	}
+	return &rateLimiter{rate: float64(bytesPerSecond), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Takes n bytes from the bucket, sleeping until they are paid for
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
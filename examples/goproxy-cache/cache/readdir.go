@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"os"
+
+	"github.com/elazarl/goproxy"
+)
+
+// With Config.ReadDirs the blobs missing from the cache directory are looked
+// up in read-only directories of the same layout, typically a seed cache on a
+// network mount shared by the nodes. Such a blob is served from where it is,
+// the downloads always land in Config.Dir. The read-only blobs do not count
+// in Config.MaxSize nor Config.MaxEntries, and are never deleted: evicting or
+// purging one only forgets it until the next miss.
+
+// Returns the file of a blob which is not inline
+func (c *Cache) filePath(shaname string, info blobInfo) string {
+	if info.readDir != "" {
+		return shardPath(info.readDir, shaname)
+	}
+	return c.blobPath(shaname)
+}
+
+// Marks AVAILABLE a blob found in the first read-only directory holding it.
+// The entry must be IN_PROGRESS; it stays so if none does and the caller
+// must fetch it. Another process writes these files, they are verified
+// before being served.
+func (c *Cache) fetchFromReadDirs(shaname string, ctx *goproxy.ProxyCtx) (blobInfo, bool) {
+	for _, dir := range c.cfg.ReadDirs {
+		fname := shardPath(dir, shaname)
+		fi, err := os.Stat(fname)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		info, err := verifyBlob(fname, digestOf(shaname))
+		if err != nil {
+			ctx.Warnf("Ignore %s: %s", fname, err)
+			continue
+		}
+		info.readDir = dir
+		info.stored = fi.ModTime()
+		ctx.Logf("Found %s in %s", shaname, dir)
+		c.CompleteFetch(shaname, info)
+		return info, true
+	}
+	return blobInfo{}, false
+}
+
+// Returns true if a read-only directory has a file for the blob
+func (c *Cache) inReadDirs(shaname string) bool {
+	for _, dir := range c.cfg.ReadDirs {
+		if _, err := os.Stat(shardPath(dir, shaname)); err == nil {
+			return true
+		}
+	}
+	return false
+}
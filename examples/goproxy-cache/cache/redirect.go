@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"net/http"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Registries commonly redirect the blob GETs to a CDN or a blob store, whose
+// URL does not name the digest. The downloads follow the redirects in the
+// proxy: the client gets the final 200 and the body is cached under the
+// digest of its request. Like the Docker client, the credentials of the
+// registry are not sent to another host, the redirect URL is signed.
+
+// Redirects followed by a blob fetch, the last one reaches the client
+const maxBlobRedirects = 5
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// Sends a blob request to the upstream, following the redirects of a GET
+func (c *Cache) upstreamRoundTrip(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+	orig := req
+	for i := 0; ; i++ {
+		resp, err := c.cfg.Upstream.RoundTrip(req)
+		if err != nil || req.Method != "GET" || !isRedirect(resp.StatusCode) || i >= maxBlobRedirects {
+			if resp != nil {
+				// The response handlers check the URL of the client request
+				resp.Request = orig
+			}
+			return resp, err
+		}
+		loc, err := resp.Location()
+		if err != nil {
+			resp.Request = orig
+			return resp, nil
+		}
+		resp.Body.Close()
+		ctx.Logf("%s redirected to %s", req.URL, loc.Redacted())
+
+		next, err := http.NewRequestWithContext(req.Context(), "GET", loc.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range req.Header {
+			next.Header[k] = v
+		}
+		if next.URL.Host != orig.URL.Host {
+			next.Header.Del("Authorization")
+			next.Header.Del("Cookie")
+		}
+		req = next
+	}
+}
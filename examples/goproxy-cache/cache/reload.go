@@ -0,0 +1,34 @@
+package cache
+
+import "fmt"
+
+// The settings of a running Cache that Reload changes, with the meaning of
+// the Config fields of the same name. Changing the other fields of Config
+// needs a new Cache.
+type Reloadable struct {
+	MaxSize        int64
+	MaxEntries     int
+	ServeRateLimit int64
+	MirrorMap      map[string]string
+}
+
+// Applies r to the running cache, the downloads and the hits in progress go
+// on: the blobs over the new limits are evicted right away, the new mirrors
+// are used by the next requests and the hits in progress keep the rate they
+// started with.
+func (c *Cache) Reload(r Reloadable) {
+	c.rm.Lock()
+	c.mirrors = r.MirrorMap
+	if old := c.serveLimiter; r.ServeRateLimit <= 0 {
+		c.serveLimiter = nil
+	} else if old == nil || int64(old.rate) != r.ServeRateLimit {
+		c.serveLimiter = newRateLimiter(r.ServeRateLimit)
+	}
+	c.rm.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cfg.MaxSize, c.cfg.MaxEntries = r.MaxSize, r.MaxEntries
+	c.evict("")
+	fmt.Printf("reload: max %d bytes and %d blobs, %d bytes in %d blobs now\n", c.cfg.MaxSize, c.cfg.MaxEntries, c.totalSize, c.available)
+}
@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Stores the blobs in an S3 bucket. The credentials are read from the
+// usual AWS environment variables or the instance IAM role.
+type s3Store struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func NewS3Store(endpoint, bucket, prefix string, secure bool) (BlobStore, error) {
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds: credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.IAM{},
+		}),
+		Secure: secure,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Store{client: client, bucket: bucket, prefix: prefix}, nil
+}
+
+func (s *s3Store) Get(shaname string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(context.Background(), s.bucket, s.prefix+shaname, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy, make sure the blob exists
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *s3Store) Put(shaname string, r io.Reader, size int64) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.prefix+shaname, r, size,
+		minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	return err
+}
+
+func (s *s3Store) Stat(shaname string) (int64, error) {
+	info, err := s.client.StatObject(context.Background(), s.bucket, s.prefix+shaname, minio.StatObjectOptions{})
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+func (s *s3Store) List(fn func(shaname string)) error {
+	for obj := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Prefix: s.prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if shaname := strings.TrimPrefix(obj.Key, s.prefix); blobNameRe.MatchString(digestOf(shaname)) {
+			fn(shaname)
+		}
+	}
+	return nil
+}
+
+func (s *s3Store) Delete(shaname string) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, s.prefix+shaname, minio.RemoveObjectOptions{})
+}
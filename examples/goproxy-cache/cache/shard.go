@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Blobs are stored in <dir>/<first two hex chars>/<digest>, like the
+// Docker registry does, so that no directory grows too big.
+//
+// With Config.NamespaceByHost the cache key of a blob (the shaname of most
+// functions) is <host>/<digest> and the blob is stored in
+// <dir>/<host>/<first two hex chars>/<digest>, so that two registries
+// disagreeing on the content of a digest do not mix up their blobs.
+
+var (
+	shardNameRe = regexp.MustCompile("^[a-f0-9]{2}$")
+	hostDirRe   = regexp.MustCompile("^[A-Za-z0-9][A-Za-z0-9._-]*$")
+	hostCharRe  = regexp.MustCompile("[^A-Za-z0-9.-]")
+)
+
+// Returns the cache key of a blob downloaded from host
+func (c *Cache) blobKey(host string, shaname string) string {
+	if !c.cfg.NamespaceByHost || host == "" {
+		return shaname
+	}
+	// The port, or an IPv6 address, must not end up in the path as is
+	return hostCharRe.ReplaceAllString(host, "_") + "/" + shaname
+}
+
+// Returns the digest part of a cache key
+func digestOf(key string) string {
+	return key[strings.LastIndex(key, "/")+1:]
+}
+
+// Splits a cache key into its host directory, empty in the flat layout, and its digest
+func splitKey(key string) (host string, shaname string) {
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+func shardPath(dir string, key string) string {
+	shaname := digestOf(key)
+	return dir + key[:len(key)-len(shaname)] + shaname[:2] + "/" + shaname
+}
+
+// A shard directory and the prefix of the keys of its blobs
+type shardDir struct {
+	prefix string
+	path   string
+}
+
+// Lists the shards of the flat layout and of every host directory
+func (c *Cache) shardDirs() ([]shardDir, error) {
+	var shards []shardDir
+	var walk func(prefix string, depth int) error
+	walk = func(prefix string, depth int) error {
+		dirs, err := ioutil.ReadDir(c.dir + prefix)
+		if err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			if !dir.IsDir() {
+				continue
+			}
+			if depth == 0 && dir.Name() == quarantineDir {
+				continue
+			}
+			if shardNameRe.MatchString(dir.Name()) {
+				shards = append(shards, shardDir{prefix, c.dir + prefix + dir.Name() + "/"})
+			} else if depth == 0 && hostDirRe.MatchString(dir.Name()) {
+				if err := walk(dir.Name()+"/", 1); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return shards, walk("", 0)
+}
+
+// A blob file and its cache key
+type blobFile struct {
+	os.FileInfo
+	key string
+}
+
+func (c *Cache) blobPath(shaname string) string {
+	return shardPath(c.dir, shaname)
+}
+
+// A blob is written in <digest>.tmp and renamed once verified, so that a
+// partial download never looks like a cached blob
+func tempPath(fname string) string {
+	return fname + ".tmp"
+}
+
+// Removes the partial downloads left by a crash. Those of another process
+// sharing the directory are kept while their lock is fresh.
+func (c *Cache) removeTempFiles() error {
+	shards, err := c.shardDirs()
+	if err != nil {
+		return err
+	}
+	for _, shard := range shards {
+		files, err := ioutil.ReadDir(shard.path)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			shaname := strings.TrimSuffix(file.Name(), ".tmp")
+			if shaname == file.Name() || !blobNameRe.MatchString(shaname) || c.lockFresh(shard.prefix+shaname) {
+				continue
+			}
+			fmt.Printf("Remove partial download %s\n", shard.prefix+file.Name())
+			os.Remove(shard.path + file.Name())
+		}
+	}
+	return nil
+}
+
+// Lists the blob files of all the shards
+func (c *Cache) listBlobs() ([]blobFile, error) {
+	shards, err := c.shardDirs()
+	if err != nil {
+		return nil, err
+	}
+
+	var blobs []blobFile
+	for _, shard := range shards {
+		files, err := ioutil.ReadDir(shard.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if !file.IsDir() && blobNameRe.MatchString(file.Name()) && strings.HasSuffix(shard.path, "/"+file.Name()[:2]+"/") {
+				blobs = append(blobs, blobFile{file, shard.prefix + file.Name()})
+			}
+		}
+	}
+	return blobs, nil
+}
+
+// Moves the blobs of the former flat layout into their shard
+func (c *Cache) migrateFlatLayout() error {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !blobNameRe.MatchString(file.Name()) {
+			continue
+		}
+		if err := mkdirMode(c.dir+file.Name()[:2], c.cfg.DirMode); err != nil {
+			return err
+		}
+		fmt.Printf("migrate: %s\n", file.Name())
+		if err := os.Rename(c.dir+file.Name(), c.blobPath(file.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
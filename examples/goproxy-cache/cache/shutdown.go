@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Counts the entries still being downloaded. c.mu must be held.
+func (c *Cache) inProgressCount() int {
+	n := 0
+	for _, entry := range c.entries {
+		if entry.status == IN_PROGRESS {
+			n++
+		}
+	}
+	return n
+}
+
+// Waits until no entry is IN_PROGRESS or ctx is done. The MITM connections
+// are hijacked, so http.Server.Shutdown does not wait for them.
+func (c *Cache) waitInProgress(ctx context.Context) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		c.mu.RLock()
+		n := c.inProgressCount()
+		c.mu.RUnlock()
+		if n == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			fmt.Printf("Shutdown timeout with %d downloads in progress\n", n)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Drops the partial files and the locks of downloads which did not complete
+// in time
+func (c *Cache) removeInProgress() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for shaname, entry := range c.entries {
+		if entry.status == IN_PROGRESS {
+			fmt.Printf("Remove partial download %s\n", shaname)
+			os.Remove(tempPath(c.blobPath(shaname)))
+			c.removeOwnLock(shaname)
+			c.setStatus(shaname, EMPTY)
+		}
+	}
+}
+
+// Stops accepting connections, lets the downloads finish, then saves the index
+func (c *Cache) Shutdown(servers []*http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	fmt.Printf("Shutting down (timeout %s)\n", timeout)
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			fmt.Printf("Shutdown of %s: %s\n", srv.Addr, err)
+		}
+	}
+	c.waitInProgress(ctx)
+	c.removeInProgress()
+	if err := c.saveIndex(); err != nil {
+		fmt.Printf("Cannot save index: %s\n", err)
+	}
+	if c.db != nil {
+		c.db.Close()
+	}
+}
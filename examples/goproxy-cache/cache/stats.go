@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Cache counters, always updated with sync/atomic
+type cacheStats struct {
+	Hits         int64 `json:"hits"`
+	Misses       int64 `json:"misses"`
+	Waits        int64 `json:"in_progress_waits"`
+	Waiting      int64 `json:"waiting"` // requests waiting for an IN_PROGRESS entry now
+	BytesServed  int64 `json:"bytes_served"`
+	BytesFetched int64 `json:"bytes_fetched"`
+	PeerHits     int64 `json:"peer_hits"`
+
+	WaitTime waitHistogram `json:"wait_seconds"`
+}
+
+func (s *cacheStats) snapshot() cacheStats {
+	return cacheStats{
+		Hits:         atomic.LoadInt64(&s.Hits),
+		Misses:       atomic.LoadInt64(&s.Misses),
+		Waits:        atomic.LoadInt64(&s.Waits),
+		Waiting:      atomic.LoadInt64(&s.Waiting),
+		BytesServed:  atomic.LoadInt64(&s.BytesServed),
+		BytesFetched: atomic.LoadInt64(&s.BytesFetched),
+		PeerHits:     atomic.LoadInt64(&s.PeerHits),
+		WaitTime:     s.WaitTime.snapshot(),
+	}
+}
+
+// Upper bounds in seconds of the buckets of waitHistogram
+var waitBuckets = [...]float64{0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+// The durations of the waits for IN_PROGRESS entries, always updated with
+// sync/atomic. A wait longer than the last bound is only in sum and count.
+type waitHistogram struct {
+	buckets [len(waitBuckets)]int64 // waits shorter than the bound, not cumulative
+	count   int64
+	sum     int64 // nanoseconds
+}
+
+func (h *waitHistogram) observe(d time.Duration) {
+	for i, bound := range waitBuckets {
+		if d.Seconds() <= bound {
+			atomic.AddInt64(&h.buckets[i], 1)
+			break
+		}
+	}
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+func (h *waitHistogram) snapshot() waitHistogram {
+	var snap waitHistogram
+	for i := range h.buckets {
+		snap.buckets[i] = atomic.LoadInt64(&h.buckets[i])
+	}
+	snap.count = atomic.LoadInt64(&h.count)
+	snap.sum = atomic.LoadInt64(&h.sum)
+	return snap
+}
+
+// Returns the cumulative counts by upper bound, as Prometheus wants them
+func (h waitHistogram) cumulative() map[float64]uint64 {
+	counts := make(map[float64]uint64, len(waitBuckets))
+	var total uint64
+	for i, bound := range waitBuckets {
+		total += uint64(h.buckets[i])
+		counts[bound] = total
+	}
+	return counts
+}
+
+func (h waitHistogram) MarshalJSON() ([]byte, error) {
+	buckets := make(map[string]uint64, len(waitBuckets))
+	for bound, n := range h.cumulative() {
+		buckets[strconv.FormatFloat(bound, 'g', -1, 64)] = n
+	}
+	return json.Marshal(struct {
+		Buckets map[string]uint64 `json:"buckets"`
+		Count   int64             `json:"count"`
+		Sum     float64           `json:"sum"`
+	}{buckets, h.count, time.Duration(h.sum).Seconds()})
+}
+
+// Counts the bytes read from a response body
+type countingReadCloser struct {
+	io.ReadCloser
+	counter *int64
+}
+
+func (c countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(c.counter, int64(n))
+	return n, err
+}
+
+func (c *Cache) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	stats := struct {
+		cacheStats
+		Connections *int64 `json:"connections,omitempty"`
+	}{cacheStats: c.stats.snapshot()}
+	if c.cfg.Connections != nil {
+		n := c.cfg.Connections()
+		stats.Connections = &n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
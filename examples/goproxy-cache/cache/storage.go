@@ -0,0 +1,166 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/elazarl/goproxy"
+)
+
+// A blob storage backend, blobs are named by their sha256 digest
+type BlobStore interface {
+	Get(shaname string) (io.ReadCloser, error)
+	Put(shaname string, r io.Reader, size int64) error
+	Stat(shaname string) (int64, error)
+	Delete(shaname string) error
+}
+
+// Stores the blobs as files in the sharded layout of dir
+type localStore struct {
+	dir      string
+	dirMode  os.FileMode
+	fileMode os.FileMode
+}
+
+func (s localStore) Get(shaname string) (io.ReadCloser, error) {
+	return os.Open(shardPath(s.dir, shaname))
+}
+
+func (s localStore) Put(shaname string, r io.Reader, size int64) error {
+	fname := shardPath(s.dir, shaname)
+	if err := mkdirMode(filepath.Dir(fname), s.dirMode); err != nil {
+		return err
+	}
+	f, err := createMode(tempPath(fname), s.fileMode)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil && size >= 0 && n != size {
+		err = fmt.Errorf("short write (%d/%d bytes)", n, size)
+	}
+	if err == nil {
+		err = os.Rename(tempPath(fname), fname)
+	}
+	if err != nil {
+		os.Remove(tempPath(fname))
+	}
+	return err
+}
+
+func (s localStore) Stat(shaname string) (int64, error) {
+	fi, err := os.Stat(shardPath(s.dir, shaname))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (s localStore) Delete(shaname string) error {
+	return os.Remove(shardPath(s.dir, shaname))
+}
+
+func (s localStore) List(fn func(shaname string)) error {
+	return filepath.Walk(s.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		shaname := fi.Name()
+		if fi.IsDir() || !blobNameRe.MatchString(shaname) || filepath.Base(filepath.Dir(path)) != shaname[:2] {
+			return nil
+		}
+		// [<host>/]<shard>/<digest>
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		fn(rel[:len(rel)-len(shaname)-3] + shaname)
+		return nil
+	})
+}
+
+// Copies a blob from the secondary tier to the local disk and marks it AVAILABLE,
+// returns its info as stored.
+// The entry must be IN_PROGRESS; it stays so if the copy fails and the
+// caller must fetch it from the upstream.
+func (c *Cache) fetchFromSecondary(shaname string, ctx *goproxy.ProxyCtx) (blobInfo, bool) {
+	size, err := c.cfg.Secondary.Stat(shaname)
+	if err != nil {
+		ctx.Logf("%s not in secondary cache: %s", shaname, err)
+		return blobInfo{}, false
+	}
+	if err := c.copyFromSecondary(shaname, size); err != nil {
+		ctx.Warnf("Cannot fetch %s from secondary cache: %s", shaname, err)
+		return blobInfo{}, false
+	}
+
+	ctx.Logf("Fetched %s from secondary cache", shaname)
+	return c.CompleteFetch(shaname, blobInfo{size: size, diskSize: size}), true
+}
+
+func (c *Cache) copyFromSecondary(shaname string, size int64) error {
+	rc, err := c.cfg.Secondary.Get(shaname)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return c.putVerified(shaname, rc, size)
+}
+
+// Stores the size bytes of r as the local file of shaname, nothing if they do
+// not have its digest
+func (c *Cache) putVerified(shaname string, r io.Reader, size int64) error {
+	if c.cfg.NoVerifyDigest {
+		return c.local.Put(shaname, r, size)
+	}
+	h := sha256.New()
+	if err := c.local.Put(shaname, io.TeeReader(r, h), size); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != digestOf(shaname) {
+		c.local.Delete(shaname)
+		return errors.New("digest mismatch")
+	}
+	return nil
+}
+
+// Uploads a verified local blob to the secondary tier, always uncompressed
+func (c *Cache) uploadToSecondary(shaname string, info blobInfo) {
+	if c.probablyInSecondary(shaname) {
+		return
+	}
+	if _, err := c.cfg.Secondary.Stat(shaname); err == nil {
+		if c.secondaryKeys != nil {
+			c.secondaryKeys.add(shaname)
+		}
+		return
+	}
+	entry := c.acquire(shaname)
+	if entry == nil {
+		// Already evicted
+		return
+	}
+	defer c.release(entry)
+	rc, size, err := c.openBlob(shaname, info)
+	if err != nil {
+		fmt.Printf("Cannot upload %s: %s\n", shaname, err)
+		return
+	}
+	defer rc.Close()
+	if err := c.cfg.Secondary.Put(shaname, rc, size); err != nil {
+		fmt.Printf("Cannot upload %s: %s\n", shaname, err)
+		return
+	}
+	if c.secondaryKeys != nil {
+		c.secondaryKeys.add(shaname)
+	}
+}
@@ -0,0 +1,287 @@
+package cache
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Stores an upstream blob in the cache while it is sent to the client
+type cacheTeeReader struct {
+	cache         *Cache
+	shaname       string
+	fname         string
+	tmpname       string // written until the blob is verified
+	f             *os.File
+	w             io.Writer    // f, bw or gz, chosen on the first chunk
+	gz            *gzip.Writer // nil if the blob is stored as-is
+	bw            *writeBehind // nil if the writes to f are synchronous
+	body          io.ReadCloser
+	hash          hash.Hash // nil with Config.NoVerifyDigest
+	ctx           *goproxy.ProxyCtx
+	nbread        int64
+	nbwritten     int64
+	expected      int64 // upstream Content-Length or size in a manifest, -1 if unknown
+	contentType   string
+	contentDigest string
+	private       bool
+	failed        bool
+	broken        bool // failed because of the upstream, see FailFetch
+	eof           bool
+	slot          bool // holds a fetch slot, released on Close
+	start         time.Time
+	touched       time.Time  // last refresh of the lock file
+	span          trace.Span // disk-write, see trace.go
+}
+
+func (c *Cache) newCacheTeeReader(shaname string, resp *http.Response, ctx *goproxy.ProxyCtx) (*cacheTeeReader, error) {
+	ctx.Logf("Create new TEE for %s", shaname)
+	tee := cacheTeeReader{
+		cache:         c,
+		shaname:       shaname,
+		fname:         c.blobPath(shaname),
+		tmpname:       tempPath(c.blobPath(shaname)),
+		ctx:           ctx,
+		body:          resp.Body,
+		expected:      resp.ContentLength,
+		contentType:   resp.Header.Get("Content-Type"),
+		contentDigest: resp.Header.Get("Docker-Content-Digest"),
+		private:       hasCredentials(resp.Request),
+		start:         time.Now(),
+	}
+
+	if size, ok := c.manifestSize(shaname); ok {
+		if tee.expected >= 0 && tee.expected != size {
+			ctx.Warnf("%s has a Content-Length of %d, its manifest says %d bytes", shaname, tee.expected, size)
+			return nil, errors.New("Size mismatch")
+		}
+		tee.expected = size
+	}
+
+	if err := c.mkdirFor(tee.fname); err != nil {
+		ctx.Warnf("Could not create directory for %s: %s", tee.fname, err)
+		return nil, errors.New("Could not create directory")
+	}
+	if locked, err := c.createLock(shaname); err != nil || !locked {
+		ctx.Warnf("Could not lock %s: %v", tee.fname, err)
+		return nil, errors.New("Could not lock file")
+	}
+	tee.touched = time.Now()
+	if !c.cfg.NoVerifyDigest {
+		tee.hash = sha256.New()
+	}
+	f, err := createMode(tee.tmpname, c.cfg.FileMode)
+	if err != nil {
+		ctx.Warnf("Could not open file %s inwrite mode", tee.tmpname)
+		ctx.Warnf("%s", err)
+		c.removeLock(shaname)
+		return nil, errors.New("Could not open file")
+	}
+	tee.f = f
+	// A sibling of upstream-fetch
+	_, tee.span = c.cfg.Tracer.Start(trace.ContextWithSpan(resp.Request.Context(), stateOf(ctx).span), "disk-write")
+	if c.cfg.WriteBuffer > 0 {
+		tee.bw = newWriteBehind(f, c.cfg.WriteBuffer)
+	}
+
+	return &tee, nil
+}
+
+func (tee *cacheTeeReader) Read(p []byte) (n int, err error) {
+	nread, err := tee.body.Read(p)
+	tee.nbread += int64(nread)
+	atomic.AddInt64(&tee.cache.stats.BytesFetched, int64(nread))
+	if nread > 0 && tee.f != nil {
+		if tee.w == nil {
+			tee.w = tee.f
+			if tee.bw != nil {
+				tee.w = tee.bw
+			}
+			if tee.cache.cfg.Compress && compressible(p[:nread]) {
+				tee.gz = gzip.NewWriter(tee.w)
+				tee.w = tee.gz
+			}
+		}
+		if tee.hash != nil {
+			tee.hash.Write(p[:nread])
+		}
+		nbytes, err2 := tee.w.Write(p[:nread])
+		tee.nbwritten += int64(nbytes)
+		if err2 != nil {
+			// Degrade to pass-through: the client still gets the bytes
+			tee.ctx.Warnf("Error writing in file %s: %s", tee.tmpname, err2)
+			tee.abort()
+		} else if max := tee.cache.cfg.MaxBlobSize; max > 0 && tee.nbwritten > max {
+			// The upstream did not tell the size
+			tee.ctx.Logf("%s is bigger than %d bytes, do not cache it", tee.shaname, max)
+			tee.abort()
+		} else if time.Since(tee.touched) > lockStaleAfter/10 {
+			tee.cache.touchLock(tee.shaname)
+			tee.touched = time.Now()
+		}
+	}
+	if err == io.EOF {
+		tee.eof = true
+	}
+	if err != nil && err != io.EOF {
+		tee.ctx.Warnf("Error reading upstream body for %s: %s", tee.shaname, err)
+		tee.failed = true
+		// A client going away is not the fault of the upstream
+		tee.broken = tee.ctx.Req.Context().Err() != context.Canceled
+	}
+
+	return nread, err
+}
+
+// Stops caching the blob right away: the partial file is removed and the
+// entry reset to EMPTY, or FAILED if the upstream broke the download; the
+// rest of the body is only passed through
+func (tee *cacheTeeReader) abort() {
+	if tee.f == nil {
+		return
+	}
+	if tee.bw != nil {
+		tee.bw.Close()
+		tee.bw = nil
+	}
+	tee.f.Close()
+	tee.f = nil
+	tee.failed = true
+	logEvent(tee.ctx, "fetch_failed", tee.shaname, "FAILED", "bytes", tee.nbwritten, "duration", since(tee.start))
+	if err := os.Remove(tee.tmpname); err != nil {
+		tee.ctx.Warnf("Cannot remove partial file %s: %s", tee.tmpname, err)
+	}
+	tee.cache.removeLock(tee.shaname)
+	if tee.broken {
+		tee.cache.FailFetch(tee.shaname)
+	} else {
+		tee.cache.CancelFetch(tee.shaname)
+	}
+	tee.span.SetStatus(codes.Error, "not cached")
+	tee.span.SetAttributes(attribute.Int64("bytes", tee.nbwritten))
+	tee.span.End()
+}
+
+func (tee *cacheTeeReader) Close() error {
+	tee.ctx.Logf("cacheTeeReader/Close for %s (nbread=%d, nbwritten=%d)", tee.shaname, tee.nbread, tee.nbwritten)
+	err := tee.body.Close()
+	if tee.slot {
+		tee.slot = false
+		tee.cache.releaseFetchSlot()
+	}
+	if tee.f == nil {
+		// Already aborted, the entry may belong to another download now
+		return err
+	}
+
+	// The body is closed before its end when the client cannot be written:
+	// the download is stopped, and it is not the fault of the upstream
+	if !tee.failed && !tee.eof {
+		tee.ctx.Logf("Client went away, download of %s stopped after %d bytes", tee.shaname, tee.nbread)
+		tee.abort()
+		return err
+	}
+
+	// A short or broken transfer must not be served as a valid cache hit. A
+	// chunked body of unknown size, ended early, is caught by the digest.
+	if !tee.failed && tee.expected >= 0 && tee.nbwritten != tee.expected {
+		tee.ctx.Warnf("Truncated download for %s (expected=%d, nbwritten=%d)", tee.shaname, tee.expected, tee.nbwritten)
+		tee.failed = true
+		tee.broken = true
+	}
+	if !tee.failed && tee.nbwritten < tee.cache.cfg.MinBlobSize {
+		// The upstream did not tell the size
+		tee.ctx.Logf("%s is smaller than %d bytes, do not cache it", tee.shaname, tee.cache.cfg.MinBlobSize)
+		tee.abort()
+		return err
+	}
+	if !tee.failed && tee.expected < 0 && tee.nbwritten == 0 && tee.hash == nil {
+		tee.ctx.Warnf("Empty download of unknown size for %s", tee.shaname)
+		tee.failed = true
+		tee.broken = true
+	}
+
+	// The cache key is the sha256 digest of the content. Hashing costs CPU on
+	// a busy node: with Config.NoVerifyDigest the operator trusts the upstream
+	// and the disk, a corrupt download is then only caught by the size check
+	// above, if the upstream sent a Content-Length, and the clients get it
+	// until they reject it on their own digest check.
+	if !tee.failed && tee.hash != nil {
+		if digest := hex.EncodeToString(tee.hash.Sum(nil)); digest != digestOf(tee.shaname) {
+			tee.ctx.Warnf("Digest mismatch for %s (computed=%s)", tee.shaname, digest)
+			tee.failed = true
+			tee.broken = true
+		}
+	}
+
+	if tee.failed {
+		tee.abort()
+		return err
+	}
+	info := blobInfo{
+		size:          tee.nbwritten,
+		diskSize:      tee.nbwritten,
+		compressed:    tee.gz != nil,
+		private:       tee.private,
+		contentType:   tee.contentType,
+		contentDigest: tee.contentDigest,
+	}
+	if tee.gz != nil {
+		if err2 := tee.gz.Close(); err2 != nil {
+			tee.ctx.Warnf("Error compressing file %s: %s", tee.tmpname, err2)
+			tee.abort()
+			return err
+		}
+	}
+	// Every byte must be on disk before the entry is AVAILABLE
+	if tee.bw != nil {
+		err2 := tee.bw.Close()
+		tee.bw = nil
+		if err2 != nil {
+			tee.ctx.Warnf("Error writing in file %s: %s", tee.tmpname, err2)
+			tee.abort()
+			return err
+		}
+	}
+	if tee.gz != nil {
+		if fi, err2 := tee.f.Stat(); err2 == nil {
+			info.diskSize = fi.Size()
+		}
+	}
+	if err2 := tee.f.Close(); err2 != nil {
+		tee.ctx.Warnf("Error closing file %s: %s", tee.tmpname, err2)
+		tee.abort()
+		return err
+	}
+	if err2 := os.Rename(tee.tmpname, tee.fname); err2 != nil {
+		tee.ctx.Warnf("Cannot rename %s: %s", tee.tmpname, err2)
+		tee.abort()
+		return err
+	}
+	tee.f = nil
+	tee.span.SetAttributes(attribute.Int64("bytes", tee.nbwritten), attribute.Int64("disk_bytes", info.diskSize))
+	tee.span.End()
+
+	logEvent(tee.ctx, "fetched", tee.shaname, "STORED", "bytes", tee.nbwritten, "disk_bytes", info.diskSize, "duration", since(tee.start))
+	tee.cache.CompleteFetch(tee.shaname, info)
+	// The file is complete: the other processes can use it
+	tee.cache.removeLock(tee.shaname)
+	if tee.cache.cfg.Secondary != nil {
+		go tee.cache.uploadToSecondary(tee.shaname, info)
+	}
+
+	return err
+}
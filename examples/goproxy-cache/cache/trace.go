@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// With Config.Tracer every proxied request gets a span, a child of the span
+// of the client if it sent a traceparent header. The span lasts until the
+// body is sent. A blob request has child spans:
+//
+//	cache-lookup      from the request to the hit or to the decision to download
+//	in-progress-wait  blocked on the download of another request, in cache-lookup
+//	upstream-fetch    from the request to the upstream to the end of its body
+//	disk-write        from the creation of the file to its commit or removal
+
+var tracePropagator = propagation.TraceContext{}
+
+// Starts the span of a request, returns the request carrying it in its context
+func (c *Cache) startRequestSpan(req *http.Request, ctx *goproxy.ProxyCtx) *http.Request {
+	parent := tracePropagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	spanCtx, span := c.cfg.Tracer.Start(parent, req.Method+" "+req.URL.Host,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.full", req.URL.String()),
+		))
+	stateOf(ctx).span = span
+	return req.WithContext(spanCtx)
+}
+
+// Ends the span of the request once the body of resp is closed
+func (c *Cache) endRequestSpan(resp *http.Response, ctx *goproxy.ProxyCtx) {
+	span := stateOf(ctx).span
+	// Without a tracer the body is left alone
+	if !span.IsRecording() {
+		return
+	}
+	if resp == nil {
+		if ctx.Error != nil {
+			span.RecordError(ctx.Error)
+			span.SetStatus(codes.Error, ctx.Error.Error())
+		}
+		span.End()
+		return
+	}
+	span.SetAttributes(
+		attribute.Int("http.response.status_code", resp.StatusCode),
+		attribute.String("cache.status", stateOf(ctx).cacheStatus()),
+	)
+	if resp.StatusCode >= 500 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	onBodyClose(resp, ctx.Req, func(bytes int64) { endSpan(span, bytes) })
+}
+
+// Ends span when body is closed, with the number of bytes read
+func endSpanOnClose(body io.ReadCloser, span trace.Span) io.ReadCloser {
+	return &countingBody{ReadCloser: body, done: func(bytes int64) { endSpan(span, bytes) }}
+}
+
+func endSpan(span trace.Span, bytes int64) {
+	span.SetAttributes(attribute.Int64("bytes", bytes))
+	span.End()
+}
+
+// Adds the in-progress-wait span of a request which waited for a download
+func (c *Cache) traceWait(parent context.Context, waited time.Duration) {
+	now := time.Now()
+	_, span := c.cfg.Tracer.Start(parent, "in-progress-wait", trace.WithTimestamp(now.Add(-waited)))
+	span.End(trace.WithTimestamp(now))
+}
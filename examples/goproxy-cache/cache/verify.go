@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With Config.VerifyOnStart every blob is hashed when the cache is loaded,
+// the index is not trusted. The blobs which do not match their digest are
+// moved to <dir>/quarantine for inspection instead of being served.
+
+const quarantineDir = "quarantine"
+
+// How often the scan reports its progress
+var verifyProgressPeriod = 10 * time.Second
+
+// The outcome of the check of a blob by verifyAll
+type verifyResult struct {
+	info blobInfo
+	err  error
+}
+
+// Hashes the blobs with Config.VerifyWorkers workers and quarantines the bad
+// ones. The results are in the order of files.
+func (c *Cache) verifyAll(files []blobFile) []verifyResult {
+	fmt.Printf("verify: checking %d blobs with %d workers\n", len(files), c.cfg.VerifyWorkers)
+	results := make([]verifyResult, len(files))
+	var checked int64
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < c.cfg.VerifyWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				info, err := verifyBlob(c.blobPath(files[i].key), digestOf(files[i].key))
+				results[i] = verifyResult{info, err}
+				atomic.AddInt64(&checked, 1)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(verifyProgressPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				fmt.Printf("verify: %d/%d blobs checked\n", atomic.LoadInt64(&checked), len(files))
+			}
+		}
+	}()
+
+	for i := range files {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	close(done)
+
+	var bad []string
+	for i, res := range results {
+		if res.err != nil {
+			fmt.Printf("verify: %s: %s\n", files[i].key, res.err)
+			c.quarantine(files[i].key)
+			bad = append(bad, files[i].key)
+		}
+	}
+	fmt.Printf("verify: %d blobs checked, %d quarantined\n", len(files), len(bad))
+	if len(bad) > 0 {
+		fmt.Printf("verify: quarantined in %s%s: %s\n", c.dir, quarantineDir, strings.Join(bad, " "))
+	}
+	return results
+}
+
+// Moves a bad blob out of the cache, it is removed if it cannot be moved
+func (c *Cache) quarantine(key string) {
+	dir := c.dir + quarantineDir
+	err := mkdirMode(dir, c.cfg.DirMode)
+	if err == nil {
+		err = os.Rename(c.blobPath(key), dir+"/"+strings.Replace(key, "/", "_", -1))
+	}
+	if err != nil {
+		fmt.Printf("Cannot quarantine %s, remove it: %s\n", key, err)
+		os.Remove(c.blobPath(key))
+	}
+}
@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The layout of the cache directory is versioned by the number in
+// <dir>/.version. At startup the older layouts are migrated one version after
+// the other, then the marker is updated. A directory without a marker is
+// either new or older than the marker: version 0, the flat layout.
+//
+// A cache written by a newer binary is refused, its layout cannot be trusted
+// to this one.
+
+const versionName = ".version"
+
+// Version of the layout written by this binary
+const layoutVersion = 1
+
+// Upgrades the layout of version i to version i+1
+var migrations = []func(c *Cache) error{
+	(*Cache).migrateFlatLayout,
+}
+
+// Returns the layout version of the cache directory, 0 if it has no marker
+func (c *Cache) readVersion() (int, error) {
+	data, err := ioutil.ReadFile(c.dir + versionName)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || version < 0 {
+		return 0, fmt.Errorf("invalid layout version %q in %s", strings.TrimSpace(string(data)), c.dir+versionName)
+	}
+	return version, nil
+}
+
+// Migrates the cache directory to layoutVersion
+func (c *Cache) migrate() error {
+	version, err := c.readVersion()
+	if err != nil {
+		return err
+	}
+	if version > layoutVersion {
+		return fmt.Errorf("%s has the layout version %d, this binary only knows up to %d", c.dir, version, layoutVersion)
+	}
+	for ; version < layoutVersion; version++ {
+		fmt.Printf("Migrate %s from layout version %d to %d\n", c.dir, version, version+1)
+		if err := migrations[version](c); err != nil {
+			return err
+		}
+		if err := c.writeVersion(version + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Atomically replaces the version marker
+func (c *Cache) writeVersion(version int) error {
+	tmp := c.dir + versionName + ".tmp"
+	f, err := createMode(tmp, c.cfg.FileMode)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte(strconv.Itoa(version) + "\n"))
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.dir+versionName)
+}
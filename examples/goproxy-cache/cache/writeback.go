@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"io"
+	"sync"
+)
+
+// Size of the chunks written by a cacheTeeReader, those of io.Copy
+const writeBehindChunk = 32 * 1024
+
+// Writes to a file from a goroutine, so that the client of a download does not
+// wait for a slow disk. At most about size bytes are queued, Write blocks
+// beyond. A write error is returned by the following Write or by Close.
+type writeBehind struct {
+	w      io.Writer
+	chunks chan []byte
+	done   chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+func newWriteBehind(w io.Writer, size int64) *writeBehind {
+	n := int(size / writeBehindChunk)
+	if n < 1 {
+		n = 1
+	}
+	wb := &writeBehind{w: w, chunks: make(chan []byte, n), done: make(chan struct{})}
+	go wb.run()
+	return wb
+}
+
+func (wb *writeBehind) run() {
+	defer close(wb.done)
+	for chunk := range wb.chunks {
+		if wb.failed() != nil {
+			// Drain the queue so that Write never blocks
+			continue
+		}
+		if _, err := wb.w.Write(chunk); err != nil {
+			wb.mu.Lock()
+			wb.err = err
+			wb.mu.Unlock()
+		}
+	}
+}
+
+func (wb *writeBehind) failed() error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	return wb.err
+}
+
+// Queues a copy of p, the caller may reuse it
+func (wb *writeBehind) Write(p []byte) (int, error) {
+	if err := wb.failed(); err != nil {
+		return 0, err
+	}
+	wb.chunks <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+// Waits until the queued chunks are written
+func (wb *writeBehind) Close() error {
+	close(wb.chunks)
+	<-wb.done
+	return wb.failed()
+}
@@ -1,12 +1,24 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"time"
 
 	"github.com/elazarl/goproxy"
 )
 
+// The embedded CA is only a demo: it is the same for every deployment.
+// Use -ca-cert and -ca-key, the clients must trust that CA.
+
 var caCert = []byte(`-----BEGIN CERTIFICATE-----
 MIIDkzCCAnugAwIBAgIJAKe/ZGdfcHdPMA0GCSqGSIb3DQEBCwUAMGAxCzAJBgNV
 BAYTAkFVMRMwEQYDVQQIDApTb21lLVN0YXRlMSEwHwYDVQQKDBhJbnRlcm5ldCBX
@@ -73,3 +85,57 @@ func setCA(caCert, caKey []byte) error {
 	goproxy.RejectConnect = &goproxy.ConnectAction{Action: goproxy.ConnectReject, TLSConfig: goproxy.TLSConfigFromCA(&goproxyCa)}
 	return nil
 }
+
+// Reads the PEM files of the MITM CA. With generate, a fresh CA is created and
+// written to the files if they do not exist yet.
+func loadCA(certFile, keyFile string, generate bool) (cert []byte, key []byte, err error) {
+	cert, err = ioutil.ReadFile(certFile)
+	if err == nil {
+		key, err = ioutil.ReadFile(keyFile)
+	}
+	if err == nil || !os.IsNotExist(err) || !generate {
+		return cert, key, err
+	}
+
+	fmt.Printf("Generate a new CA in %s and %s\n", certFile, keyFile)
+	if cert, key, err = generateCA(); err != nil {
+		return nil, nil, err
+	}
+	if err := ioutil.WriteFile(keyFile, key, 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := ioutil.WriteFile(certFile, cert, 0644); err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// Creates a self-signed CA. goproxy signs the MITM certificates with RSA keys only.
+func generateCA() (cert []byte, key []byte, err error) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	hostname, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "goproxy-cache CA " + hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	key = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	return cert, key, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerateCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")
+
+	if _, _, err := loadCA(certFile, keyFile, false); err == nil {
+		t.Fatal("missing CA files should be an error without generate")
+	}
+	cert, key, err := loadCA(certFile, keyFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setCA(cert, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// The generated CA is reused on the next start
+	cert2, key2, err := loadCA(certFile, keyFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cert, cert2) || !bytes.Equal(key, key2) {
+		t.Fatal("the CA was generated again")
+	}
+}
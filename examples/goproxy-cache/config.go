@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// The -config file is YAML. Its keys are the names of the flags, or one of
+// the aliases below; a repeatable flag takes a list. A flag given on the
+// command line overrides the file:
+//
+//	dir: /var/cache/registry
+//	addr: [":8080", "unix:/run/goproxy-cache.sock"]
+//	max-size: 50GB
+//	ttl: 720h
+var configAliases = map[string]string{
+	"dir":      "d",
+	"cachedir": "d",
+	"verbose":  "v",
+}
+
+// Sets the flags of fs which are not set yet from the config file fname
+func loadConfigFile(fs *flag.FlagSet, fname string) error {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("%s: %s", fname, err)
+	}
+
+	keys := make([]string, 0, len(values))
+	var unknown []string
+	for key := range values {
+		if f := fs.Lookup(configFlagName(key)); f == nil || f.Name == "config" {
+			unknown = append(unknown, key)
+		}
+		keys = append(keys, key)
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("%s: unknown keys %s", fname, strings.Join(unknown, ", "))
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	sort.Strings(keys)
+	for _, key := range keys {
+		f := fs.Lookup(configFlagName(key))
+		if set[f.Name] {
+			continue
+		}
+		items, isList := values[key].([]interface{})
+		if !isList {
+			items = []interface{}{values[key]}
+		} else if _, repeatable := f.Value.(*stringList); !repeatable {
+			return fmt.Errorf("%s: %s takes a single value", fname, key)
+		}
+		for _, item := range items {
+			switch item.(type) {
+			case map[string]interface{}, []interface{}, nil:
+				return fmt.Errorf("%s: invalid value for %s", fname, key)
+			}
+			if err := fs.Set(f.Name, fmt.Sprint(item)); err != nil {
+				return fmt.Errorf("%s: %s: %s", fname, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Parses "Name: value" headers
+func parseHeaders(lines []string) (http.Header, error) {
+	header := make(http.Header)
+	for _, line := range lines {
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid header %q, expected \"Name: value\"", line)
+		}
+		header.Add(strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]))
+	}
+	return header, nil
+}
+
+// Parses "host=mirror" mappings
+func parseMirrorMap(mappings []string) (map[string]string, error) {
+	hosts := make(map[string]string)
+	for _, mapping := range mappings {
+		i := strings.Index(mapping, "=")
+		if i <= 0 || i == len(mapping)-1 || strings.Contains(mapping, "/") {
+			return nil, fmt.Errorf("invalid mirror mapping %q, expected host=mirror", mapping)
+		}
+		hosts[strings.TrimSpace(mapping[:i])] = strings.TrimSpace(mapping[i+1:])
+	}
+	return hosts, nil
+}
+
+// Reads the digests of a -pin-file, one per line. Blank lines and # comments
+// are ignored.
+func readPinFile(fname string) ([]string, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var digests []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			digests = append(digests, line)
+		}
+	}
+	return digests, nil
+}
+
+func configFlagName(key string) string {
+	if name, ok := configAliases[key]; ok {
+		return name
+	}
+	return key
+}
+
+// The effective configuration is the value of every flag once the config
+// file and the defaults computed by main are applied. It is logged at startup
+// and served by GET /_cache/config on the management listener.
+
+// Flags naming a private key, the path is masked too
+var secretFlags = map[string]bool{
+	"ca-key":     true,
+	"listen-key": true,
+}
+
+const redacted = "<redacted>"
+
+// Returns the flags of fs by name, the repeatable ones as a list
+func effectiveConfig(fs *flag.FlagSet) map[string]interface{} {
+	config := make(map[string]interface{})
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		switch {
+		case secretFlags[f.Name] && value != "":
+			config[f.Name] = redacted
+		case isList(f.Value):
+			list := []string{}
+			for _, item := range *f.Value.(*stringList) {
+				list = append(list, redactURL(item))
+			}
+			config[f.Name] = list
+		default:
+			config[f.Name] = redactURL(value)
+		}
+	})
+	return config
+}
+
+func isList(v flag.Value) bool {
+	_, ok := v.(*stringList)
+	return ok
+}
+
+// Masks the password of a URL, like the one of -parent-proxy, and its query
+// which may carry a token, like the one of -evict-webhook
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return s
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = redacted
+	}
+	return u.Redacted()
+}
+
+func configHandler(config map[string]interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(config)
+	}
+}
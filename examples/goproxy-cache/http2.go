@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/elazarl/goproxy"
+)
+
+// HTTP/2 is negotiated with the upstreams over TLS, so that the downloads of a
+// pull are multiplexed on a few connections. The proxy port also accepts h2c
+// (HTTP/2 with prior knowledge) for the plain requests, but a CONNECT needs
+// HTTP/1.1: goproxy hijacks the connection. Inside a MITM'd tunnel the clients
+// speak HTTP/1.1 too, the TLS config of goproxy does not offer h2.
+
+func configureHTTP2(proxy *goproxy.ProxyHttpServer, http1Only bool) {
+	proxy.Tr.ForceAttemptHTTP2 = !http1Only
+}
+
+// Returns the server of a proxy listener
+func proxyServer(addr string, proxy http.Handler, http1Only bool) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: proxy}
+	if !http1Only {
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+		srv.Handler = http1Connect(proxy)
+	}
+	return srv
+}
+
+// Rejects the CONNECTs which cannot be hijacked
+func http1Connect(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "CONNECT" && r.ProtoMajor != 1 {
+			http.Error(w, "CONNECT needs HTTP/1.1", http.StatusHTTPVersionNotSupported)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Listen addresses are host:port, or unix:<path> for a unix socket
+
+func isUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, "unix:")
+}
+
+// The socket left by a previous run is removed first. The socket file is
+// removed again when the listener is closed by the shutdown.
+func listen(addr string) (net.Listener, error) {
+	if !isUnixAddr(addr) {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, "unix:")
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(true)
+	return ln, nil
+}
+
+// Counts and bounds the connections accepted by all the proxy listeners: at
+// the limit Accept waits for a connection to be closed, the clients beyond it
+// stay in the backlog of the socket instead of being rejected
+type connLimit struct {
+	slots  chan struct{} // nil if unlimited
+	active int64         // open connections, always updated with sync/atomic
+}
+
+// 0 means unlimited
+func newConnLimit(n int) *connLimit {
+	if n <= 0 {
+		return &connLimit{}
+	}
+	return &connLimit{slots: make(chan struct{}, n)}
+}
+
+func (cl *connLimit) acquire(closed chan struct{}) bool {
+	if cl.slots == nil {
+		return true
+	}
+	select {
+	case cl.slots <- struct{}{}:
+		return true
+	case <-closed:
+		return false
+	}
+}
+
+func (cl *connLimit) release() {
+	if cl.slots != nil {
+		<-cl.slots
+	}
+}
+
+func (cl *connLimit) count() int64 {
+	return atomic.LoadInt64(&cl.active)
+}
+
+type limitListener struct {
+	net.Listener
+	limit  *connLimit
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (cl *connLimit) listener(ln net.Listener) net.Listener {
+	return &limitListener{Listener: ln, limit: cl, closed: make(chan struct{})}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	if !l.limit.acquire(l.closed) {
+		return nil, net.ErrClosed
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		l.limit.release()
+		return nil, err
+	}
+	atomic.AddInt64(&l.limit.active, 1)
+	return &limitConn{Conn: conn, limit: l.limit}, nil
+}
+
+func (l *limitListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+type limitConn struct {
+	net.Conn
+	limit *connLimit
+	once  sync.Once
+}
+
+// Keeps the sendfile(2) of net/http, which needs an io.ReaderFrom connection
+func (c *limitConn) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(c.Conn, r)
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		atomic.AddInt64(&c.limit.active, -1)
+		c.limit.release()
+	})
+	return err
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnLimit(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := newConnLimit(1)
+	ln := limit.listener(inner)
+	defer ln.Close()
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+	}
+
+	first, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	select {
+	case <-accepted:
+		t.Fatal("the second connection should wait for the first one")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n := limit.count(); n != 1 {
+		t.Fatalf("expected 1 connection, got %d", n)
+	}
+
+	first.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the second connection should be accepted once the first one is closed")
+	}
+	if n := limit.count(); n != 0 {
+		t.Fatalf("expected 0 connection, got %d", n)
+	}
+}
@@ -1,241 +1,381 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
-	_ "bytes"
-	"io/ioutil"
-	"regexp"
+	"net/url"
 	"strings"
+	"regexp"
 	"os"
-	"io"
-	"fmt"
-	"sync"
-	"errors"
+	"os/signal"
+	"syscall"
 	"time"
 	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/examples/goproxy-cache/cache"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
-const (
-	// Constants for cache entry status
-	EMPTY = 0
-	AVAILABLE = 1
-	IN_PROGRESS = 2
-)
-
-var (
-	re = regexp.MustCompile("/registry-v2/docker/registry/v2/blobs/sha256/../(?P<shaname>[^/]+)/")
-	cachedir string
-	cache map[string]int
-	m sync.RWMutex
-)
-
-type cacheTeeReader struct {
-	shaname string
-	fname string
-	f *os.File
-	body io.ReadCloser
-	ctx *goproxy.ProxyCtx
-	nbread int
-	nbwritten int
-}
-
-func newCacheTeeReader(shaname string, body io.ReadCloser, ctx *goproxy.ProxyCtx) (*cacheTeeReader, error) {
-	ctx.Logf("Create new TEE for %s", shaname)
-	tee := cacheTeeReader{
-		shaname: shaname,
-		fname: cachedir + shaname,
-		ctx: ctx,
-		body: body,
-		f: nil,
-		nbread: 0,
-		nbwritten: 0,
-	}
+// Docker Hub serves the blobs from its CDN after a redirect
+var dockerHubHosts = stringList{"index.docker.io", "registry-1.docker.io", "production.cloudflare.docker.com"}
 
-	f, err := os.Create(tee.fname)
-	if err != nil {
-		ctx.Warnf("Could not open file %s inwrite mode", tee.fname)
-		ctx.Warnf("%s", err)
-		return nil, errors.New("Could not open file")
+// Matches any of the hosts, with an optional port
+func upstreamsRegexp(hosts []string) *regexp.Regexp {
+	quoted := make([]string, len(hosts))
+	for i, host := range hosts {
+		quoted[i] = regexp.QuoteMeta(host)
 	}
-	tee.f = f
-
-	return &tee, nil
+	return regexp.MustCompile("^(" + strings.Join(quoted, "|") + ")(:[0-9]+)?$")
 }
 
-func (tee *cacheTeeReader) Read(p []byte) (n int, err error) {
-	//tee.ctx.Logf("cacheTeeReader/Read for %s", tee.shaname)
-	nread, err := tee.body.Read(p)
-	tee.nbread += nread
-	if nread > 0 {
-		nbytes, err2 := tee.f.Write(p[:nread])
-		//tee.ctx.Logf("nread=%d, nwritten=%d", nread, nbytes)
-		tee.nbwritten += nbytes
-		if err2 != nil {
-			tee.ctx.Warnf("Error writing in file %s", tee.fname)
-		}
-	}
+// A flag that can be repeated
+type stringList []string
 
-	return nread, err
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
 }
 
-func (tee *cacheTeeReader) Close() error {
-	tee.ctx.Logf("cacheTeeReader/Close for %s (nbread=%d, nbwritten=%d)", tee.shaname, tee.nbread, tee.nbwritten)
-	tee.f.Close()
-	m.Lock()
-	cache[tee.shaname] = AVAILABLE
-	defer m.Unlock()
-
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
 	return nil
 }
 
-func cacheInit() {
-	// Assume cachedir ends with a /
-	if !strings.HasSuffix(cachedir, "/") {
-		cachedir = cachedir + "/"
+func main() {
+	configFile := flag.String("config", "", "YAML file setting any of these flags, the command line overrides it")
+	verbose := flag.Bool("v", false, "log every step of the proxy requests, same as -log-level debug")
+	quiet := flag.Bool("quiet", false, "only log the errors, same as -log-level error")
+	logLevel := flag.String("log-level", "info", "log level: error, warn, info (the hits and misses) or debug")
+	var addrs stringList
+	flag.Var(&addrs, "addr", "proxy listen address (default :8080), host:port or unix:<path>, can be repeated")
+	var cfg cache.Config
+	flag.StringVar(&cfg.Dir, "d", "/tmp/proxy", "directory where to store cache")
+	flag.Var((*stringList)(&cfg.ReadDirs), "read-dir", "read-only directory of the same layout where the blobs missing from -d are looked up, can be repeated")
+	dirMode, fileMode := cache.ModeValue(cache.DefaultDirMode), cache.ModeValue(cache.DefaultFileMode)
+	flag.Var(&dirMode, "dir-mode", "mode of the cache directories, in octal")
+	flag.Var(&fileMode, "file-mode", "mode of the cache files, in octal")
+	flag.BoolVar(&cfg.NoCache, "no-cache", false, "forward every request without caching, to check whether a problem comes from the cache")
+	flag.BoolVar(&cfg.NamespaceByHost, "namespace-by-host", false, "key the blobs by upstream host and digest, in case two registries disagree on the content of a digest")
+	verifyDigest := flag.Bool("verify-digest", true, "check the sha256 of every download, false only checks the size to save CPU on nodes trusting their upstream and storage")
+	flag.BoolVar(&cfg.VerifyOnStart, "verify-on-start", false, "hash every blob at startup and move those not matching their digest to the quarantine directory")
+	flag.IntVar(&cfg.VerifyWorkers, "verify-workers", 0, "concurrent blob checks of -verify-on-start, 0 means the number of CPUs")
+	flag.Var((*cache.SizeValue)(&cfg.MaxSize), "max-size", "maximum size of the cache (e.g. 20GB), 0 means unlimited")
+	serveRateLimit := flag.Float64("serve-rate-limit", 0, "MB/s served from the cache by all the clients together, to protect the disk bandwidth, 0 means unlimited")
+	flag.IntVar(&cfg.MaxEntries, "max-entries", 0, "maximum number of cached blobs, so that tiny blobs do not exhaust the inodes, 0 means unlimited")
+	flag.Var((*cache.SizeValue)(&cfg.DiskReserve), "disk-reserve", "free space kept on the cache filesystem (e.g. 5GB), a blob which would eat into it is not cached, 0 means no check")
+	flag.Var((*cache.SizeValue)(&cfg.MaxBlobSize), "max-blob-size", "blobs bigger than this are not cached (e.g. 2GB), 0 means unlimited")
+	flag.Var((*cache.SizeValue)(&cfg.InlineBlobSize), "inline-blob-size", "blobs up to this size (e.g. 16KB) are stored in a database rather than in a file each, 0 disables it")
+	flag.Var((*cache.SizeValue)(&cfg.MinBlobSize), "min-blob-size", "blobs smaller than this are not cached (e.g. 1KB), 0 caches them all")
+	flag.StringVar(&cfg.EvictPolicy, "evict-policy", cache.EvictLRU, "which blobs are evicted first: lru (least recently used) or lfu (least hit)")
+	flag.BoolVar(&cfg.Compress, "compress", false, "store the blobs gzipped, except those which do not compress well")
+	flag.Var((*cache.SizeValue)(&cfg.WriteBuffer), "write-buffer", "bytes of each download queued for a background disk writer (e.g. 8MB), so that a slow disk does not slow down the clients, 0 means synchronous writes")
+	flag.DurationVar(&cfg.ManifestTTL, "manifest-ttl", 5 * time.Minute, "how long manifests pulled by tag are cached")
+	flag.DurationVar(&cfg.CatalogTTL, "catalog-ttl", 0, "how long the /v2/_catalog answers are cached, per credentials, 0 disables it")
+	flag.BoolVar(&cfg.MirrorPushes, "mirror-pushes", false, "cache the blobs pushed through the proxy, so that the next pulls are hits")
+	flag.BoolVar(&cfg.PrefetchLayers, "prefetch-layers", false, "pull the missing layers of an image manifest in the background when it is pulled")
+	flag.BoolVar(&cfg.ServeStaleOnError, "serve-stale-on-error", false, "serve an expired manifest when the upstream cannot be reached, with a Warning header")
+	flag.BoolVar(&cfg.ManifestRevalidate, "manifest-revalidate", true, "revalidate expired tags with If-None-Match instead of downloading them again")
+	var blobRegexps stringList
+	flag.Var(&blobRegexps, "blob-regexp", "additional blob URL regexp with a (?P<shaname>...) group, can be repeated")
+	flag.Var((*stringList)(&cfg.AllowMediaTypes), "allow-media-type", "only cache the blobs of this media type, a trailing * matches a prefix, can be repeated")
+	flag.Var((*stringList)(&cfg.DenyMediaTypes), "deny-media-type", "never cache the blobs of this media type, a trailing * matches a prefix, can be repeated")
+	adminAddr := flag.String("admin-addr", "", "listen address of the management endpoints, disabled if empty")
+	flag.StringVar(&cfg.ReadyCheckURL, "ready-check-url", "", "URL of the upstream requested by /_cache/readyz (e.g. https://index.docker.io/v2/), no check if empty")
+	metricsAddr := flag.String("metrics-addr", "", "listen address of the Prometheus /metrics endpoint, disabled if empty")
+	ttl := flag.Duration("ttl", 0, "remove blobs not accessed for this long (e.g. 720h), 0 disables expiry")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30 * time.Second, "how long to wait for downloads in progress on shutdown")
+	s3Endpoint := flag.String("s3-endpoint", "", "S3 endpoint of the secondary cache tier, disabled if empty")
+	s3Bucket := flag.String("s3-bucket", "", "S3 bucket of the secondary cache tier")
+	s3Prefix := flag.String("s3-prefix", "", "key prefix of the blobs in the S3 bucket")
+	s3Insecure := flag.Bool("s3-insecure", false, "use plain HTTP to talk to the S3 endpoint")
+	flag.IntVar(&cfg.FetchRetries, "fetch-retries", 3, "how many times a blob fetch failing with a 502, 503, 504 or a network error is retried")
+	flag.IntVar(&cfg.MaxConcurrentFetches, "max-concurrent-fetches", 0, "maximum number of concurrent blob fetches from the upstream, 0 means unlimited")
+	flag.DurationVar(&cfg.FetchTimeout, "fetch-timeout", 0, "deadline of a whole blob fetch, body included, 0 means none")
+	flag.DurationVar(&cfg.NegativeTTL, "negative-ttl", 0, "how long an upstream 404 of a blob is served by the cache, 0 disables it")
+	flag.DurationVar(&cfg.FailureCooldown, "failure-cooldown", 10*time.Second, "how long the requests for a blob whose download failed are passed through, 0 retries at once")
+	headerTimeout := flag.Duration("upstream-header-timeout", time.Minute, "how long to wait for the headers of an upstream response, 0 means forever")
+	maxConns := flag.Int("max-connections", 0, "maximum number of client connections, the next ones wait for a slot, 0 means unlimited")
+	useTLS := flag.Bool("tls", false, "serve the proxy over HTTPS with -listen-cert and -listen-key")
+	listenCert := flag.String("listen-cert", "", "PEM certificate of the -tls listeners, distinct from the MITM -ca-cert")
+	listenKey := flag.String("listen-key", "", "PEM private key of -listen-cert")
+	http1Only := flag.Bool("http1", false, "only speak HTTP/1.1 with the clients and the upstreams, for compatibility")
+	idleTimeout := flag.Duration("upstream-idle-timeout", 90 * time.Second, "how long an idle upstream connection is kept open, 0 means forever")
+	idlePerHost := flag.Int("upstream-max-idle-conns-per-host", 32, "idle connections kept open to each upstream host for the next requests")
+	connsPerHost := flag.Int("upstream-max-conns-per-host", 0, "maximum number of connections to each upstream host, 0 means unlimited")
+	dialTimeout := flag.Duration("upstream-dial-timeout", 10*time.Second, "how long to wait for a connection to an upstream host")
+	evictHook := flag.String("evict-webhook", "", "URL getting a JSON POST for every blob evicted, expired or purged")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "URL of the OTLP/HTTP collector receiving the traces (e.g. http://localhost:4318), no tracing if empty")
+	accessLog := flag.String("access-log", "", "file getting a Combined Log Format line per request, - for stdout, reopened on SIGHUP")
+	logFormat := flag.String("log-format", "text", "log format: text or json")
+	warm := flag.String("warm", "", "file listing image references to pull in the cache at startup")
+	caCertFile := flag.String("ca-cert", "", "PEM file of the CA signing the MITM certificates, the embedded demo CA if empty")
+	caKeyFile := flag.String("ca-key", "", "PEM file of the private key of the -ca-cert CA")
+	caGenerate := flag.Bool("ca-generate", false, "generate a new CA in -ca-cert and -ca-key if they do not exist")
+	parentProxy := flag.String("parent-proxy", "", "URL of the proxy to reach the upstream through (e.g. http://egress:3128), HTTP_PROXY and HTTPS_PROXY are used if empty")
+	var peers stringList
+	flag.Var(&peers, "peers", "base URL of another proxy asked for a blob before the upstream (e.g. http://cache2:8080), can be repeated")
+	flag.DurationVar(&cfg.PeerTimeout, "peer-timeout", 2*time.Second, "how long a peer has to answer before the next one or the upstream is tried")
+	var hitHeaders stringList
+	flag.Var(&hitHeaders, "hit-header", "header added to the responses served from the cache (e.g. \"Cache-Control: max-age=31536000\"), can be repeated")
+	pinFile := flag.String("pin-file", "", "file listing the digests ([host/]sha256:...) of the blobs never evicted nor expired, one per line")
+	var upstreams stringList
+	flag.Var(&upstreams, "upstream", "registry host to intercept (default the Docker Hub hosts), can be repeated")
+	mitmAll := flag.Bool("mitm-all", false, "intercept every HTTPS host, not only the -upstream ones")
+	var mirrorMap stringList
+	flag.Var(&mirrorMap, "mirror-map", "send the requests for an upstream host to a mirror (e.g. registry-1.docker.io=mirror.internal), can be repeated")
+	mirrorMode := flag.Bool("mirror-mode", false, "serve the /v2/ requests as a registry mirror of the single -upstream (default registry-1.docker.io), no CONNECT is intercepted")
+	flag.Parse()
+	cmdline := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { cmdline[f.Name] = true })
+	if *configFile != "" {
+		if err := loadConfigFile(flag.CommandLine, *configFile); err != nil {
+			log.Fatal(err)
+		}
 	}
-
-	if stat, err := os.Stat(cachedir); err != nil || !stat.IsDir() {
-		fmt.Printf("Directory %s does not exists - try to create it\n", cachedir)
-		if err := os.Mkdir(cachedir, 0755); err != nil {
-			fmt.Printf("Cannot create directory %s\n", cachedir)
+	loaded := flagValues(flag.CommandLine)
+	if len(addrs) == 0 {
+		addrs = stringList{":8080"}
+	}
+	// goproxy-cache [flags] selftest <image>, see selftest.go
+	selftestImage := ""
+	if flag.Arg(0) == "selftest" {
+		if flag.NArg() != 2 {
+			log.Fatal("usage: goproxy-cache [flags] selftest <image>")
+		}
+		if *mirrorMode {
+			log.Fatal("selftest cannot check -mirror-mode")
+		}
+		dir, err := ioutil.TempDir("", "goproxy-cache-selftest")
+		if err != nil {
 			log.Fatal(err)
 		}
+		cfg.Dir = dir
+		selftestImage = flag.Arg(1)
+	} else if flag.NArg() > 0 {
+		log.Fatalf("unknown command %q", flag.Arg(0))
+	}
+	var mirror *url.URL
+	if *mirrorMode {
+		u, err := mirrorUpstream(upstreams)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mirror = u
+	} else if len(upstreams) == 0 {
+		upstreams = dockerHubHosts
+	}
+	cfg.BlobRegexps = blobRegexps
+	cfg.NoVerifyDigest = !*verifyDigest
+	cfg.Peers = peers
+	headers, err := parseHeaders(hitHeaders)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.HitHeaders = headers
+	if cfg.MirrorMap, err = parseMirrorMap(mirrorMap); err != nil {
+		log.Fatal(err)
+	}
+	if *pinFile != "" {
+		if cfg.Pinned, err = readPinFile(*pinFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	cfg.ServeRateLimit = int64(*serveRateLimit * (1 << 20))
+	cfg.DirMode, cfg.FileMode = os.FileMode(dirMode), os.FileMode(fileMode)
+	if *s3Endpoint != "" {
+		store, err := cache.NewS3Store(*s3Endpoint, *s3Bucket, *s3Prefix, !*s3Insecure)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.Secondary = store
+	}
+	if *caCertFile != "" || *caKeyFile != "" {
+		cert, key, err := loadCA(*caCertFile, *caKeyFile, *caGenerate)
+		if err != nil {
+			log.Fatal(err)
+		}
+		caCert, caKey = cert, key
 	} else {
-		fmt.Printf("Directory %s exists\n", cachedir)
+		fmt.Println("Warning: using the embedded demo CA, set -ca-cert and -ca-key")
 	}
-
-	// Load the cache
-	cache = make(map[string]int)
-	files, err := ioutil.ReadDir(cachedir)
+	if err := setCA(caCert, caKey); err != nil {
+		log.Fatal(err)
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	if *parentProxy != "" {
+		if err := cache.SetParentProxy(proxy, *parentProxy); err != nil {
+			log.Fatal(err)
+		}
+	}
+	configureHTTP2(proxy, *http1Only)
+	proxy.Tr.ResponseHeaderTimeout = *headerTimeout
+	proxy.Tr.IdleConnTimeout = *idleTimeout
+	configureTransport(proxy.Tr, *idlePerHost, *connsPerHost, *dialTimeout)
+	conns := newConnLimit(*maxConns)
+	cfg.Connections = conns.count
+	if *evictHook != "" {
+		cfg.OnEvict = evictWebhook(*evictHook)
+	}
+	var tracerProvider *sdktrace.TracerProvider
+	if *otlpEndpoint != "" {
+		if tracerProvider, err = newTracerProvider(*otlpEndpoint); err != nil {
+			log.Fatal(err)
+		}
+		cfg.Tracer = tracerProvider.Tracer("goproxy-cache")
+	}
+	var al *cache.AccessLog
+	if *accessLog != "" {
+		if al, err = cache.OpenAccessLog(*accessLog); err != nil {
+			log.Fatal(err)
+		}
+		cfg.AccessLog = al
+	}
+	c, err := cache.RegisterCache(proxy, cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	for _, file := range files {
-		fmt.Printf("cache: %s\n", file.Name())
-		cache[file.Name()] = AVAILABLE
+	go c.SaveIndexEvery(time.Minute)
+	go c.RefreshSecondaryKeysEvery(10 * time.Minute)
+	if *ttl > 0 {
+		go c.ExpireEvery(*ttl)
 	}
-}
-
-// Returns "" or the name of the layer
-func shouldBeCached(urlpath string, ctx *goproxy.ProxyCtx) string {
-	ctx.Logf("shouldBeCached: %s", urlpath)
-	if res := re.FindStringSubmatch(urlpath); res != nil && len(res) > 1 {
-		ctx.Logf("....yes....: %s", res[1])
-		return res[1]
+	// The other CONNECTs are tunneled as is, so that the proxy can be the
+	// HTTPS proxy of the whole system
+	if mirror == nil {
+		proxy.OnRequest(goproxy.ReqHostMatches(upstreamsRegexp(upstreams))).HandleConnect(goproxy.AlwaysMitm)
 	}
-
-	ctx.Logf("....no....")
-	return ""
-}
-
-func cacheExistsFor(blob string, ctx *goproxy.ProxyCtx) bool {
-	fname := cachedir + blob
-	if _, err := os.Stat(fname); os.IsNotExist(err) {
-		ctx.Logf("File %s does not exist", fname)
-		return false
+	if *mitmAll {
+		proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	}
+	level, err := logLevelOf(*logLevel, *verbose, *quiet)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cache.SetupLogging(*logFormat, level, proxy)
+	// SIGHUP reopens the access log and reloads the config file, see reload.go
+	if al != nil || *configFile != "" {
+		reloader := &configReloader{fname: *configFile, fs: flag.CommandLine, cmdline: cmdline, applied: loaded, cache: c}
+		go func() {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			for range hup {
+				if al != nil {
+					if err := al.Reopen(); err != nil {
+						fmt.Printf("Cannot reopen the access log: %s\n", err)
+					}
+				}
+				if *configFile != "" {
+					if err := reloader.reload(); err != nil {
+						fmt.Printf("Cannot reload %s: %s\n", *configFile, err)
+					}
+				}
+			}
+		}()
 	}
 
-	return true
-}
+	config := effectiveConfig(flag.CommandLine)
+	if data, err := json.Marshal(config); err == nil {
+		fmt.Printf("Configuration: %s\n", data)
+	}
 
-func CacheReqHandler(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-	ctx.Logf("CacheReqHandler")
+	// Requests which are not proxied (relative URL) are served by the admin routes
+	proxy.NonproxyHandler = c.AdminHandler(false)
+	if selftestImage != "" {
+		status := selftest(proxyServer("", proxy, *http1Only), selftestImage)
+		os.RemoveAll(cfg.Dir)
+		os.Exit(status)
+	}
+	if mirror != nil {
+		fmt.Printf("Mirror of %s\n", mirror)
+		proxy.NonproxyHandler = mirrorHandler(proxy, mirror, proxy.NonproxyHandler)
+	}
+	if *adminAddr != "" {
+		admin := c.AdminHandler(true)
+		admin.Handle("/_cache/config", configHandler(config))
+		go func() {
+			log.Fatal(http.ListenAndServe(*adminAddr, admin))
+		}()
+	}
 
-    	if shaname := shouldBeCached(req.URL.Path, ctx); shaname != "" {
-		ctx.Logf("Check Cache for %s", shaname)
-		m.Lock()
-		in_cache := cache[shaname]
+	if *metricsAddr != "" {
+		reg := cache.NewMetricsRegistry(c)
+		go func() {
+			metrics := http.NewServeMux()
+			metrics.Handle("/metrics", cache.MetricsHandler(reg))
+			log.Fatal(http.ListenAndServe(*metricsAddr, metrics))
+		}()
+	}
 
-		// Wait for other download
-		for in_cache == IN_PROGRESS { 
-			ctx.Logf("Locked on cache in progress")
-			m.Unlock()
-			time.Sleep(2 * time.Second)
-			m.Lock()
-			in_cache = cache[shaname]
+	var listenerCert tls.Certificate
+	if *useTLS {
+		if *listenCert == "" || *listenKey == "" {
+			log.Fatal("-tls needs -listen-cert and -listen-key")
 		}
-
-		if in_cache == AVAILABLE {
-			m.Unlock()
-			ctx.Logf("Cache Exists: return it !")
-
-			f, err := os.Open(cachedir + shaname)
-			if err != nil {
-				ctx.Warnf("Cannot open and read file %s", cachedir + shaname)
-				return req, nil
-			}
-			fi, err := os.Stat(cachedir + shaname)
-			if err != nil {
-				ctx.Warnf("Cannot stat file %s", cachedir + shaname)
-				return req, nil
-			}
-
-			resp := &http.Response{}
-			resp.Request = req
-			resp.TransferEncoding = req.TransferEncoding
-			resp.Header = make(http.Header)
-			resp.Header.Add("Content-Type", "application/octet-stream")
-			resp.StatusCode = 200
-			resp.ContentLength = fi.Size()
-			resp.Body = ioutil.NopCloser(f)
-			return req, resp
-		} else {
-			ctx.Logf("Not in cache")
-			cache[shaname] = IN_PROGRESS
-			m.Unlock()
+		if listenerCert, err = tls.LoadX509KeyPair(*listenCert, *listenKey); err != nil {
+			log.Fatal(err)
 		}
 	}
-
-	return req, nil
-}
-
-func CacheRespHandler(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
-	ctx.Logf("CacheRespHandler")
-	fmt.Println(resp.Header)
-
-	// Note: resp contains resp.request
-	if resp.StatusCode != 200 {
-		return resp
+	// Every listener serves the same proxy
+	var servers []*http.Server
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		ln, err := listen(addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners = append(listeners, conns.listener(ln))
+		srv := proxyServer(addr, proxy, *http1Only)
+		if *useTLS {
+			configureTLS(srv, listenerCert)
+		}
+		servers = append(servers, srv)
 	}
-
-    	if shaname := shouldBeCached(resp.Request.URL.Path, ctx); shaname != "" {
-		m.Lock()
-		in_cache := cache[shaname]
-		m.Unlock()
-
-		if in_cache == AVAILABLE {
-			ctx.Logf("%s already in cache", shaname)
-		} else {
-			ctx.Logf("Should set in Cache: %s", resp.Request.URL.Path)
-			ctx.Logf("shaname=%s", shaname)
-
-			tee, err := newCacheTeeReader(shaname, resp.Body, ctx)
-			if err == nil {
-				resp.Body = tee
-			} else {
-				ctx.Warnf("newCacheTeeReader failed")
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		c.Shutdown(servers, *shutdownTimeout)
+		if tracerProvider != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+			if err := tracerProvider.Shutdown(ctx); err != nil {
+				fmt.Printf("Cannot export the last spans: %s\n", err)
+			}
+			cancel()
+		}
+		close(done)
+	}()
+	// The listeners are ready: the warming requests can go through the proxy
+	if *warm != "" && *useTLS {
+		fmt.Println("Cannot warm the cache: -warm needs a plain HTTP listener")
+	} else if *warm != "" {
+		warmed := false
+		for _, addr := range addrs {
+			if !isUnixAddr(addr) {
+				go warmCache(*warm, addr)
+				warmed = true
+				break
 			}
 		}
+		if !warmed {
+			fmt.Println("Cannot warm the cache: -warm needs a TCP -addr")
+		}
 	}
-	
-	return resp
-}
-
-func main() {
-	verbose := flag.Bool("v", false, "should every proxy request be logged to stdout")
-	addr := flag.String("addr", ":8080", "proxy listen address")
-	flag.StringVar(&cachedir, "d", "/tmp/proxy", "directory where to store cache")
-	flag.Parse()
-	cacheInit()
-	setCA(caCert, caKey)
-	proxy := goproxy.NewProxyHttpServer()
-	proxy.OnRequest(goproxy.ReqHostMatches(regexp.MustCompile("^index.docker.io$"))).HandleConnect(goproxy.AlwaysMitm)
-	proxy.OnRequest().Do(goproxy.FuncReqHandler(CacheReqHandler))
-	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
-	proxy.OnResponse().Do(goproxy.FuncRespHandler(CacheRespHandler))
-	proxy.Verbose = *verbose
-	log.Fatal(http.ListenAndServe(*addr, proxy))
+	for i, srv := range servers {
+		go func(srv *http.Server, ln net.Listener) {
+			serve := srv.Serve
+			if srv.TLSConfig != nil {
+				serve = func(ln net.Listener) error { return srv.ServeTLS(ln, "", "") }
+			}
+			if err := serve(ln); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}(srv, listeners[i])
+	}
+	<-done
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// With -mirror-mode the proxy is the registry itself, for the clients
+// configured with a registry mirror (the registry-mirrors of dockerd): the
+// /v2/ requests it gets, with a relative URL, are sent to the fixed upstream
+// through the proxy handlers, so they are cached like the intercepted ones.
+// No CONNECT is intercepted and the clients do not need the MITM CA.
+
+// Upstream of the mirror mode when -upstream is not set
+const defaultMirrorUpstream = "registry-1.docker.io"
+
+// Returns the URL of the upstream registry, a host is reached over HTTPS
+func mirrorUpstream(upstreams []string) (*url.URL, error) {
+	if len(upstreams) == 0 {
+		upstreams = []string{defaultMirrorUpstream}
+	}
+	if len(upstreams) > 1 {
+		return nil, fmt.Errorf("-mirror-mode needs a single -upstream, got %d", len(upstreams))
+	}
+	upstream := upstreams[0]
+	if !strings.Contains(upstream, "://") {
+		upstream = "https://" + upstream
+	}
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid -upstream %q", upstreams[0])
+	}
+	return u, nil
+}
+
+// Proxies the registry requests to upstream, the other ones go to fallback
+func mirrorHandler(proxy http.Handler, upstream *url.URL, fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2" && !strings.HasPrefix(r.URL.Path, "/v2/") {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		r.URL.Scheme = upstream.Scheme
+		r.URL.Host = upstream.Host
+		r.Host = upstream.Host
+		proxy.ServeHTTP(w, r)
+	})
+}
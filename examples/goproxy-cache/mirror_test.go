@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/examples/goproxy-cache/cache"
+)
+
+func TestMirrorMode(t *testing.T) {
+	blob := []byte("a layer of the mirrored image")
+	sum := sha256.Sum256(blob)
+	blobPath := "/v2/library/test/blobs/sha256:" + hex.EncodeToString(sum[:])
+	var requests int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		if r.URL.Path != blobPath {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(blob)
+	}))
+	defer upstream.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	c, err := cache.RegisterCache(proxy, cache.Config{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(upstream.URL)
+	proxy.NonproxyHandler = mirrorHandler(proxy, u, c.AdminHandler(false))
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(srv.URL + blobPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != string(blob) {
+			t.Fatalf("mirror returned %s %q", resp.Status, body)
+		}
+	}
+	if n := atomic.LoadInt64(&requests); n != 1 {
+		t.Fatalf("expected 1 upstream request, got %d", n)
+	}
+	resp, err := http.Get(srv.URL + "/_cache/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("admin route behind the mirror returned %s", resp.Status)
+	}
+}
+
+func TestMirrorUpstream(t *testing.T) {
+	for _, test := range []struct {
+		upstreams []string
+		want      string
+	}{
+		{nil, "https://registry-1.docker.io"},
+		{[]string{"registry.internal:5000"}, "https://registry.internal:5000"},
+		{[]string{"http://registry.internal"}, "http://registry.internal"},
+		{[]string{"a.test", "b.test"}, ""},
+		{[]string{"ftp://registry.internal"}, ""},
+	} {
+		u, err := mirrorUpstream(test.upstreams)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%v: expected an error, got %s", test.upstreams, u)
+			}
+		} else if err != nil || u.String() != test.want {
+			t.Errorf("%v: got %v %v, want %s", test.upstreams, u, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/elazarl/goproxy/examples/goproxy-cache/cache"
+)
+
+// On SIGHUP the -config file is read again and the settings below are applied
+// to the running proxy, the pulls in progress go on. The command line still
+// overrides the file, and a key removed from the file goes back to its
+// default. The file is applied entirely or not at all: an invalid file is
+// logged and the running settings are kept.
+//
+// Every other setting needs a restart: the listeners and TLS, the CA and the
+// intercepted hosts, the directories and the tiers, the TTLs, the timeouts
+// and the sizes of the downloads... A change to one of them is logged, and
+// not applied. GET /_cache/config keeps showing the startup configuration.
+var reloadableFlags = map[string]bool{
+	"log-level":        true,
+	"v":                true,
+	"quiet":            true,
+	"serve-rate-limit": true,
+	"max-size":         true,
+	"max-entries":      true,
+	"mirror-map":       true,
+}
+
+type configReloader struct {
+	fname   string
+	fs      *flag.FlagSet
+	cmdline map[string]bool   // the flags of fs set on the command line
+	applied map[string]string // flagValues of fs as loaded from the file, before main changes them
+	cache   *cache.Cache
+}
+
+func (r *configReloader) reload() error {
+	fs, err := rereadConfigFile(r.fs, r.cmdline, r.fname)
+	if err != nil {
+		return err
+	}
+	level, err := logLevelOf(fs.Lookup("log-level").Value.String(), isTrue(fs, "v"), isTrue(fs, "quiet"))
+	if err != nil {
+		return err
+	}
+	mirrors, err := parseMirrorMap(*fs.Lookup("mirror-map").Value.(*stringList))
+	if err != nil {
+		return err
+	}
+
+	values := flagValues(fs)
+	var restart []string
+	for name, value := range values {
+		if !reloadableFlags[name] && value != r.applied[name] {
+			restart = append(restart, name)
+		}
+	}
+	if len(restart) > 0 {
+		sort.Strings(restart)
+		fmt.Printf("reload: restart to apply the changes of %v\n", restart)
+	}
+	cache.SetLogLevel(level)
+	r.cache.Reload(cache.Reloadable{
+		MaxSize:        int64(*fs.Lookup("max-size").Value.(*cache.SizeValue)),
+		MaxEntries:     fs.Lookup("max-entries").Value.(flag.Getter).Get().(int),
+		ServeRateLimit: int64(fs.Lookup("serve-rate-limit").Value.(flag.Getter).Get().(float64) * (1 << 20)),
+		MirrorMap:      mirrors,
+	})
+	// The settings needing a restart are reported again until then
+	for name := range reloadableFlags {
+		r.applied[name] = values[name]
+	}
+	return nil
+}
+
+// Reads fname again into a copy of the flags of fs with their defaults, or
+// their values if they were set on the command line
+func rereadConfigFile(fs *flag.FlagSet, cmdline map[string]bool, fname string) (*flag.FlagSet, error) {
+	copied := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value := reflect.New(reflect.TypeOf(f.Value).Elem()).Interface().(flag.Value)
+		copied.Var(value, f.Name, f.Usage)
+		switch {
+		case cmdline[f.Name] && isList(f.Value):
+			for _, item := range *f.Value.(*stringList) {
+				if err2 := copied.Set(f.Name, item); err == nil {
+					err = err2
+				}
+			}
+		case cmdline[f.Name]:
+			if err2 := copied.Set(f.Name, f.Value.String()); err == nil {
+				err = err2
+			}
+		case !isList(value):
+			if err2 := value.Set(f.DefValue); err == nil {
+				err = err2
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copied, loadConfigFile(copied, fname)
+}
+
+func flagValues(fs *flag.FlagSet) map[string]string {
+	values := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) { values[f.Name] = f.Value.String() })
+	return values
+}
+
+func isTrue(fs *flag.FlagSet, name string) bool {
+	return fs.Lookup(name).Value.String() == "true"
+}
+
+// The log level of -log-level, -v and -quiet
+func logLevelOf(name string, verbose bool, quiet bool) (cache.LogLevel, error) {
+	level, err := cache.ParseLogLevel(name)
+	if err != nil {
+		return level, err
+	}
+	if verbose {
+		level = cache.LevelDebug
+	} else if quiet {
+		level = cache.LevelError
+	}
+	return level, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/elazarl/goproxy/examples/goproxy-cache/cache"
+)
+
+// The flags of main that reload reads, and one needing a restart
+func reloadFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("config", "", "")
+	fs.String("log-level", "info", "")
+	fs.Bool("v", false, "")
+	fs.Bool("quiet", false, "")
+	fs.Float64("serve-rate-limit", 0, "")
+	var maxSize cache.SizeValue
+	fs.Var(&maxSize, "max-size", "")
+	fs.Int("max-entries", 0, "")
+	var mirrors stringList
+	fs.Var(&mirrors, "mirror-map", "")
+	fs.String("d", "/tmp/proxy", "")
+	return fs
+}
+
+func rewriteConfig(t *testing.T, fname string, config string) {
+	if err := ioutil.WriteFile(fname, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRereadConfigFile(t *testing.T) {
+	fname := writeConfig(t, "max-size: 1GB\nmax-entries: 10\nmirror-map: [a=b]\n")
+	fs := reloadFlags()
+	fs.Parse([]string{"-max-entries", "5", "-mirror-map", "c=d"})
+	if err := loadConfigFile(fs, fname); err != nil {
+		t.Fatal(err)
+	}
+
+	// max-size is removed, the command line still wins
+	rewriteConfig(t, fname, "log-level: warn\nmax-entries: 20\nmirror-map: [e=f]\n")
+	reread, err := rereadConfigFile(fs, map[string]bool{"max-entries": true, "mirror-map": true}, fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := flagValues(reread)
+	for name, want := range map[string]string{"log-level": "warn", "max-size": "0", "max-entries": "5", "mirror-map": "c=d", "d": "/tmp/proxy", "v": "false"} {
+		if values[name] != want {
+			t.Errorf("%s is %q, want %q", name, values[name], want)
+		}
+	}
+	// The running flags are left alone
+	if got := fs.Lookup("max-size").Value.String(); got != "1073741824" {
+		t.Errorf("max-size changed to %s", got)
+	}
+}
+
+func TestReload(t *testing.T) {
+	fname := writeConfig(t, "max-size: 1GB\nd: /tmp/a\n")
+	fs := reloadFlags()
+	fs.Parse(nil)
+	if err := loadConfigFile(fs, fname); err != nil {
+		t.Fatal(err)
+	}
+	c, err := cache.NewCache(cache.Config{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &configReloader{fname: fname, fs: fs, cmdline: map[string]bool{}, applied: flagValues(fs), cache: c}
+	defer cache.SetLogLevel(cache.LevelInfo)
+
+	rewriteConfig(t, fname, "max-size: 2GB\nlog-level: debug\nmirror-map: [a=b]\nd: /tmp/b\n")
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if cache.CurrentLogLevel() != cache.LevelDebug {
+		t.Error("log level not reloaded")
+	}
+	// Only the reloaded settings are applied, the others are reported until a restart
+	if r.applied["max-size"] != "2147483648" || r.applied["d"] != "/tmp/a" {
+		t.Errorf("applied %v", r.applied)
+	}
+
+	// Nothing is applied from an invalid file
+	for _, config := range []string{"log-level: loud\n", "mirror-map: [nomirror]\n", "unknown: 1\n", "max-size: 3GB\nmax-entries: many\n"} {
+		rewriteConfig(t, fname, config)
+		applied := make(map[string]string)
+		for name, value := range r.applied {
+			applied[name] = value
+		}
+		if err := r.reload(); err == nil {
+			t.Errorf("%q reloaded", config)
+		}
+		if !reflect.DeepEqual(r.applied, applied) {
+			t.Errorf("%q partially applied: %v", config, r.applied)
+		}
+	}
+}
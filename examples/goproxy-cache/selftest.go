@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// The selftest subcommand checks a deployment end to end without a docker
+// daemon: the proxy configured by the flags is started on a loopback port,
+// with a temporary cache directory, an image is pulled through it twice like
+// -warm does, and every blob of the second pull must be a cache hit according
+// to its X-Cache header. The -addr, -tls and management listeners are not
+// started, so it can run next to the deployed proxy.
+
+type pullResult struct {
+	blobs    int
+	hits     int
+	bytes    int64
+	duration time.Duration
+}
+
+func selftestPull(addr string, ref imageRef) (pullResult, error) {
+	var res pullResult
+	c, err := newWarmClient(addr)
+	if err != nil {
+		return res, err
+	}
+	c.onBlob = func(resp *http.Response, size int64) {
+		res.blobs++
+		res.bytes += size
+		if resp.Header.Get("X-Cache") == "HIT" {
+			res.hits++
+		}
+	}
+	start := time.Now()
+	err = c.warm(ref)
+	res.duration = time.Since(start)
+	return res, err
+}
+
+// Pulls image twice through srv, prints a summary and returns the exit status
+func selftest(srv *http.Server, image string) int {
+	ref, err := parseImageRef(image)
+	if err != nil {
+		fmt.Printf("selftest: FAIL %s\n", err)
+		return 1
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Printf("selftest: FAIL %s\n", err)
+		return 1
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	for i := 1; i <= 2; i++ {
+		res, err := selftestPull(ln.Addr().String(), ref)
+		if err != nil {
+			fmt.Printf("selftest: FAIL pull %d of %s: %s\n", i, ref, err)
+			return 1
+		}
+		fmt.Printf("selftest: pull %d of %s: %d blobs, %d hits, %d bytes in %s\n", i, ref, res.blobs, res.hits, res.bytes, res.duration.Round(time.Millisecond))
+		if i == 2 && res.hits != res.blobs {
+			fmt.Printf("selftest: FAIL %d blobs of the second pull were not served from the cache\n", res.blobs-res.hits)
+			return 1
+		}
+	}
+	fmt.Println("selftest: PASS")
+	return 0
+}
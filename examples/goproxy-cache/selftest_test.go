@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/examples/goproxy-cache/cache"
+)
+
+// A registry serving a single image of two layers over HTTPS
+func newSelftestRegistry(t *testing.T) *httptest.Server {
+	blobs := map[string][]byte{}
+	var layers []string
+	for _, content := range []string{"first layer", "second layer", "{}"} {
+		sum := sha256.Sum256([]byte(content))
+		digest := "sha256:" + hex.EncodeToString(sum[:])
+		blobs["/v2/test/image/blobs/"+digest] = []byte(content)
+		layers = append(layers, fmt.Sprintf(`{"digest":"%s","size":%d}`, digest, len(content)))
+	}
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"config":%s,"layers":[%s]}`, layers[2], strings.Join(layers[:2], ","))
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/test/image/manifests/v1" {
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+			w.Write([]byte(manifest))
+			return
+		}
+		blob, ok := blobs[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(blob)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestSelftest(t *testing.T) {
+	upstream := newSelftestRegistry(t)
+	image := strings.TrimPrefix(upstream.URL, "https://") + "/test/image:v1"
+
+	for _, noCache := range []bool{false, true} {
+		proxy := goproxy.NewProxyHttpServer()
+		proxy.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		if _, err := cache.RegisterCache(proxy, cache.Config{Dir: t.TempDir(), NoCache: noCache}); err != nil {
+			t.Fatal(err)
+		}
+		proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+
+		status := selftest(proxyServer("", proxy, false), image)
+		if want := map[bool]int{false: 0, true: 1}[noCache]; status != want {
+			t.Fatalf("selftest with NoCache=%v exited with %d", noCache, status)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// With -tls the clients reach the proxy itself over HTTPS, with the
+// certificate of -listen-cert. It is not the MITM CA: that one signs the
+// certificates of the upstreams inside the tunnels. A CONNECT is then a TLS
+// connection in a TLS connection, goproxy hijacks the outer one like a plain
+// TCP connection.
+//
+// HTTP/2 is not offered on the TLS listener: the clients would send their
+// CONNECT over it and goproxy could not hijack them.
+
+// Serves srv over TLS with cert, only with HTTP/1.1
+func configureTLS(srv *http.Server, cert tls.Certificate) {
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.Protocols = new(http.Protocols)
+	srv.Protocols.SetHTTP1(true)
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// The blob downloads of a pull go to a few upstream hosts, many at a time. The
+// default transport keeps only 2 idle connections per host: under heavy miss
+// traffic the others are closed after each response and opened again for the
+// next one.
+
+// Tunes the connection reuse of the upstream transport, perHost 0 means unlimited
+func configureTransport(tr *http.Transport, idlePerHost int, perHost int, dialTimeout time.Duration) {
+	tr.MaxIdleConnsPerHost = idlePerHost
+	tr.MaxConnsPerHost = perHost
+	tr.DialContext = (&net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}).DialContext
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Counts the connections the upstream gets for rounds of concurrent requests
+// through a proxy
+func upstreamConnections(t *testing.T, setup func(*http.Transport)) int64 {
+	const clients, rounds = 16, 5
+	var conns int64
+	var barrier sync.WaitGroup
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// All the requests of a round are in flight at once
+		barrier.Done()
+		barrier.Wait()
+		w.Write([]byte("a layer"))
+	}))
+	upstream.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	setup(proxy.Tr)
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), MaxIdleConnsPerHost: clients}}
+
+	for round := 0; round < rounds; round++ {
+		barrier.Add(clients)
+		var wg sync.WaitGroup
+		for i := 0; i < clients; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := client.Get(upstream.URL)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+			}()
+		}
+		wg.Wait()
+	}
+	return atomic.LoadInt64(&conns)
+}
+
+func TestConfigureTransport(t *testing.T) {
+	before := upstreamConnections(t, func(tr *http.Transport) {})
+	after := upstreamConnections(t, func(tr *http.Transport) {
+		configureTransport(tr, 32, 0, 10*time.Second)
+	})
+	t.Logf("upstream connections: %d with the default transport, %d tuned", before, after)
+	if after > 16 || after >= before {
+		t.Fatalf("the tuned transport should reuse its connections, got %d (%d before)", after, before)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Cache warming pulls images through the proxy itself, so that the manifests
+// and blobs take the same CacheReqHandler/CacheRespHandler path as a docker pull.
+
+var manifestAccept = strings.Join([]string{
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}, ", ")
+
+type imageRef struct {
+	registry  string
+	name      string
+	reference string // tag or digest
+}
+
+func (ref imageRef) String() string {
+	sep := ":"
+	if strings.Contains(ref.reference, ":") {
+		sep = "@"
+	}
+	return ref.registry + "/" + ref.name + sep + ref.reference
+}
+
+// Parses references like ubuntu, quay.io/coreos/etcd:v3.5 or alpine@sha256:...
+func parseImageRef(s string) (imageRef, error) {
+	ref := imageRef{registry: "registry-1.docker.io", reference: "latest"}
+	if s == "" {
+		return ref, errors.New("empty image reference")
+	}
+
+	if i := strings.Index(s, "@"); i >= 0 {
+		s, ref.reference = s[:i], s[i+1:]
+	} else if i := strings.LastIndex(s, ":"); i > strings.LastIndex(s, "/") {
+		s, ref.reference = s[:i], s[i+1:]
+	}
+
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.registry, s = parts[0], parts[1]
+	}
+	if ref.registry == "docker.io" || ref.registry == "index.docker.io" {
+		ref.registry = "registry-1.docker.io"
+	}
+	if ref.registry == "registry-1.docker.io" && !strings.Contains(s, "/") {
+		s = "library/" + s
+	}
+	ref.name = s
+	return ref, nil
+}
+
+type warmClient struct {
+	client *http.Client
+	token  string
+	onBlob func(resp *http.Response, size int64) // if set, called for every blob pulled
+}
+
+// Returns a client using the proxy listening at addr, trusting its MITM CA
+func newWarmClient(addr string) (*warmClient, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	proxyURL := &url.URL{Scheme: "http", Host: net.JoinHostPort(host, port)}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(goproxy.GoproxyCa.Leaf)
+	return &warmClient{client: &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}}}, nil
+}
+
+var challengeRe = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// Gets an anonymous token from the realm of a Bearer challenge
+func (c *warmClient) authenticate(challenge string) error {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return fmt.Errorf("unsupported challenge %q", challenge)
+	}
+	params := url.Values{}
+	realm := ""
+	for _, kv := range challengeRe.FindAllStringSubmatch(challenge, -1) {
+		if kv[1] == "realm" {
+			realm = kv[2]
+		} else {
+			params.Set(kv[1], kv[2])
+		}
+	}
+	if realm == "" {
+		return errors.New("no realm in challenge")
+	}
+
+	resp, err := c.client.Get(realm + "?" + params.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("token request failed: %s", resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return err
+	}
+	c.token = token.Token
+	if c.token == "" {
+		c.token = token.AccessToken
+	}
+	return nil
+}
+
+// GETs a registry URL, answering the token challenge once if needed
+func (c *warmClient) get(u string, accept string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			resp.Body.Close()
+			if err := c.authenticate(resp.Header.Get("Www-Authenticate")); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+		}
+		return resp, nil
+	}
+}
+
+type descriptor struct {
+	Digest   string `json:"digest"`
+	Platform *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform,omitempty"`
+}
+
+type manifestDoc struct {
+	Config    *descriptor  `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+func (c *warmClient) manifest(ref imageRef, reference string) (*manifestDoc, error) {
+	resp, err := c.get("https://"+ref.registry+"/v2/"+ref.name+"/manifests/"+reference, manifestAccept)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var doc manifestDoc
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// Pulls the manifest and all the blobs of an image, for the linux platform
+// of the proxy architecture when the reference is a manifest list
+func (c *warmClient) warm(ref imageRef) error {
+	doc, err := c.manifest(ref, ref.reference)
+	if err != nil {
+		return err
+	}
+	if len(doc.Manifests) > 0 {
+		digest := ""
+		for _, d := range doc.Manifests {
+			if d.Platform != nil && d.Platform.OS == "linux" && d.Platform.Architecture == runtime.GOARCH {
+				digest = d.Digest
+				break
+			}
+		}
+		if digest == "" {
+			return fmt.Errorf("no linux/%s manifest", runtime.GOARCH)
+		}
+		if doc, err = c.manifest(ref, digest); err != nil {
+			return err
+		}
+	}
+
+	blobs := doc.Layers
+	if doc.Config != nil {
+		blobs = append(blobs, *doc.Config)
+	}
+	for _, blob := range blobs {
+		resp, err := c.get("https://"+ref.registry+"/v2/"+ref.name+"/blobs/"+blob.Digest, "")
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("blob %s: %s", blob.Digest, err)
+		}
+		if c.onBlob != nil {
+			c.onBlob(resp, n)
+		}
+	}
+	return nil
+}
+
+// Reads the image references of fname, one per line, and pulls them through
+// the proxy listening at addr. Blank lines and # comments are ignored.
+func warmCache(fname string, addr string) {
+	f, err := os.Open(fname)
+	if err != nil {
+		fmt.Printf("warm: cannot open %s: %s\n", fname, err)
+		return
+	}
+	defer f.Close()
+
+	var refs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			refs = append(refs, line)
+		}
+	}
+
+	failed := 0
+	for _, s := range refs {
+		ref, err := parseImageRef(s)
+		if err == nil {
+			var c *warmClient
+			if c, err = newWarmClient(addr); err == nil {
+				err = c.warm(ref)
+			}
+		}
+		if err != nil {
+			failed++
+			fmt.Printf("warm: FAILED %s: %s\n", s, err)
+		} else {
+			fmt.Printf("warm: ok %s\n", ref)
+		}
+	}
+	fmt.Printf("warm: %d images, %d failed\n", len(refs), failed)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// The evictions are queued and POSTed one by one in the background: the
+// cache calls OnEvict with its lock held and must not wait for the webhook.
+// Events are dropped if the webhook cannot keep up.
+
+const webhookQueue = 1024
+
+type evictEvent struct {
+	Event  string    `json:"event"`
+	Digest string    `json:"digest"`
+	Size   int64     `json:"size"`
+	Time   time.Time `json:"time"`
+}
+
+// Returns an OnEvict callback POSTing the evictions to url as JSON
+func evictWebhook(url string) func(digest string, size int64) {
+	events := make(chan evictEvent, webhookQueue)
+	client := &http.Client{Timeout: 10 * time.Second}
+	go func() {
+		for ev := range events {
+			if err := postEvent(client, url, ev); err != nil {
+				fmt.Printf("Cannot notify the eviction of %s: %s\n", ev.Digest, err)
+			}
+		}
+	}()
+	return func(digest string, size int64) {
+		select {
+		case events <- evictEvent{Event: "evict", Digest: digest, Size: size, Time: time.Now().UTC()}:
+		default:
+			fmt.Printf("Eviction webhook queue full, drop the event of %s\n", digest)
+		}
+	}
+}
+
+func postEvent(client *http.Client, url string, ev evictEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
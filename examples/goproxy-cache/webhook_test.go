@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEvictWebhook(t *testing.T) {
+	got := make(chan evictEvent, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev evictEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Error(err)
+		}
+		got <- ev
+	}))
+	defer srv.Close()
+
+	evictWebhook(srv.URL)("sha256:1234", 42)
+	select {
+	case ev := <-got:
+		if ev.Event != "evict" || ev.Digest != "sha256:1234" || ev.Size != 42 {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook was not called")
+	}
+}
@@ -2,6 +2,7 @@ package goproxy
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
 	"io"
@@ -186,7 +187,18 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 			}
 			defer rawClientTls.Close()
 			clientTlsReader := bufio.NewReader(rawClientTls)
-			for !isEof(clientTlsReader) {
+			var watching chan struct{} // see watchClient
+			// Cancels the context of the request being answered, once its
+			// response is written or by watchClient
+			cancel := context.CancelFunc(func() {})
+			defer func() { cancel() }()
+			for {
+				if watching != nil {
+					<-watching
+				}
+				if isEof(clientTlsReader) {
+					break
+				}
 				req, err := http.ReadRequest(clientTlsReader)
 				var ctx = &ProxyCtx{Req: req, Session: atomic.AddInt64(&proxy.sess, 1), proxy: proxy}
 				if err != nil && err != io.EOF {
@@ -203,6 +215,15 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 					req.URL, err = url.Parse("https://" + r.Host + req.URL.String())
 				}
 
+				if req.Body == http.NoBody {
+					var reqCtx context.Context
+					reqCtx, cancel = context.WithCancel(req.Context())
+					req = req.WithContext(reqCtx)
+					watching = watchClient(clientTlsReader, cancel)
+				} else {
+					watching = nil
+				}
+
 				// Bug fix which goproxy fails to provide request
 				// information URL in the context when does HTTPS MITM
 				ctx.Req = req
@@ -234,6 +255,22 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 					ctx.Warnf("Cannot write TLS response HTTP status from mitm'd client: %v", err)
 					return
 				}
+				// A response to a HEAD, a 204 or a 304 has no body: a terminating
+				// chunk would be read by the client as the next response
+				if ctx.Req.Method == "HEAD" || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+					resp.Header.Del("Transfer-Encoding")
+					resp.Header.Set("Connection", "close")
+					if err := resp.Header.Write(rawClientTls); err != nil {
+						ctx.Warnf("Cannot write TLS response header from mitm'd client: %v", err)
+						return
+					}
+					if _, err = io.WriteString(rawClientTls, "\r\n"); err != nil {
+						ctx.Warnf("Cannot write TLS response header end from mitm'd client: %v", err)
+						return
+					}
+					cancel()
+					continue
+				}
 				// Since we don't know the length of resp, return chunked encoded response
 				// TODO: use a more reasonable scheme
 				resp.Header.Del("Content-Length")
@@ -261,6 +298,7 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 					ctx.Warnf("Cannot write TLS response chunked trailer from mitm'd client: %v", err)
 					return
 				}
+				cancel()
 			}
 			ctx.Logf("Exiting on EOF")
 		}()
@@ -277,6 +315,22 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 	}
 }
 
+// Cancels the context of a MITM'd request when its client goes away, so that
+// a download nobody reads is stopped. Every response is sent with
+// Connection: close, the client has nothing more to send: Peek only returns
+// when the connection is closed. The request must not have a body, it would be
+// read from r too. The returned channel is closed when r can be used again.
+func watchClient(r *bufio.Reader, cancel context.CancelFunc) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := r.Peek(1); err != nil {
+			cancel()
+		}
+	}()
+	return done
+}
+
 func httpError(w io.WriteCloser, ctx *ProxyCtx, err error) {
 	if _, err := io.WriteString(w, "HTTP/1.1 502 Bad Gateway\r\n\r\n"); err != nil {
 		ctx.Warnf("Error responding to client: %s", err)
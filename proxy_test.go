@@ -3,6 +3,7 @@ package goproxy_test
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
@@ -17,6 +18,7 @@ import (
 	"os/exec"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/elazarl/goproxy"
 	"github.com/elazarl/goproxy/ext/image"
@@ -469,6 +471,89 @@ func TestMitmIsFiltered(t *testing.T) {
 	}
 }
 
+func TestMitmBodilessResponses(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest(goproxy.UrlIs("/nocontent")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return nil, goproxy.NewResponse(req, "", http.StatusNoContent, "")
+	})
+	proxy.OnRequest(goproxy.UrlIs("/notmodified")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return nil, goproxy.NewResponse(req, "", http.StatusNotModified, "")
+	})
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	tlsConn, buf := mitmTunnel(l)
+	defer tlsConn.Close()
+
+	// Every response is read from the same tunnel: a body sent after one of
+	// them would be read as the status line of the next one
+	for _, c := range []struct {
+		method, path string
+		status       int
+		body         string
+	}{
+		{"HEAD", "/bobo", http.StatusOK, ""},
+		{"GET", "/nocontent", http.StatusNoContent, ""},
+		{"GET", "/notmodified", http.StatusNotModified, ""},
+		{"GET", "/bobo", http.StatusOK, "bobo"},
+	} {
+		req, err := http.NewRequest(c.method, https.URL+c.path, nil)
+		panicOnErr(err, "NewRequest")
+		panicOnErr(req.Write(tlsConn), "req.Write")
+		resp, err := http.ReadResponse(buf, req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", c.method, c.path, err)
+		}
+		body := string(readAll(resp.Body, t))
+		resp.Body.Close()
+		if resp.StatusCode != c.status || body != c.body {
+			t.Errorf("%s %s: got %d %q, expected %d %q", c.method, c.path, resp.StatusCode, body, c.status, c.body)
+		}
+	}
+}
+
+// Opens a tunnel to https through the MITM'ing proxy l
+func mitmTunnel(l *httptest.Server) (*tls.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", l.Listener.Addr().String())
+	panicOnErr(err, "dial proxy")
+	connect, err := http.NewRequest("CONNECT", "//"+https.Listener.Addr().String(), nil)
+	panicOnErr(err, "NewRequest")
+	panicOnErr(connect.Write(conn), "req(CONNECT).Write")
+	readConnectResponse(bufio.NewReader(conn))
+	tlsConn := tls.Client(conn, acceptAllCerts)
+	return tlsConn, bufio.NewReader(tlsConn)
+}
+
+func TestMitmRequestContextIsDone(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	reqCtx := make(chan context.Context, 1)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		reqCtx <- req.Context()
+		return req, nil
+	})
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	tlsConn, buf := mitmTunnel(l)
+	defer tlsConn.Close()
+
+	req, err := http.NewRequest("GET", https.URL+"/bobo", nil)
+	panicOnErr(err, "NewRequest")
+	panicOnErr(req.Write(tlsConn), "req.Write")
+	resp, err := http.ReadResponse(buf, req)
+	panicOnErr(err, "resp.Read")
+	readAll(resp.Body, t)
+	resp.Body.Close()
+
+	// The tunnel is still open
+	select {
+	case <-(<-reqCtx).Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context of an answered request not cancelled")
+	}
+}
+
 func TestFirstHandlerMatches(t *testing.T) {
 	proxy := goproxy.NewProxyHttpServer()
 	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {